@@ -0,0 +1,356 @@
+package gofn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+	"github.com/nuveo/log"
+)
+
+const (
+	defaultScaleInterval     = 10 * time.Second
+	defaultScaleDownCooldown = 5 * time.Minute
+	// a failed scale up is not retried for minScaleUpBackoff, doubled after
+	// each failure up to maxScaleUpBackoff
+	minScaleUpBackoff = time.Second
+	maxScaleUpBackoff = 2 * time.Minute
+)
+
+// AutoscalerOptions configures an Autoscaler
+type AutoscalerOptions struct {
+	// MinMachines are kept even without invocations
+	MinMachines int
+	// MaxMachines caps the number of machines, zero does not cap them
+	MaxMachines int
+	// Concurrency is the number of invocations run at the same time in a
+	// machine, zero runs one at a time
+	Concurrency int
+	// ScaleUpCooldown is the minimum time between two scale ups, a machine
+	// which fails to be created also delays the next scale up by a backoff
+	// from 1 second to 2 minutes
+	ScaleUpCooldown time.Duration
+	// ScaleDownCooldown is how long the machines are not scaled before the
+	// ones in excess are deleted, zero waits 5 minutes
+	ScaleDownCooldown time.Duration
+	// Interval is how often the machines are scaled besides when an
+	// invocation starts waiting, zero scales them every 10 seconds
+	Interval time.Duration
+	// StateFile keeps the machines like MachineManagerOptions.StateFile
+	StateFile string
+	// Leases keeps the leases of the machines like
+	// MachineManagerOptions.Leases
+	Leases LeaseHolder
+}
+
+// AutoscalerStats describes the machines and invocations of an Autoscaler
+type AutoscalerStats struct {
+	Machines int
+	Creating int
+	// Running is the number of invocations running in the machines and
+	// Pending the ones waiting for a machine
+	Running int
+	Pending int
+}
+
+// Autoscaler runs the invocations in a fleet of machines sized by the
+// number of pending and running invocations. Machines are created ahead of
+// the invocations and deleted after ScaleDownCooldown without scaling, a
+// machine with running invocations or running gofn containers is not
+// deleted
+type Autoscaler struct {
+	m    *MachineManager
+	opts AutoscalerOptions
+	// ctx cancels the scale down checks on Close, the machines being
+	// created are not canceled so they are not left behind
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// only used by the scaling goroutine after NewAutoscaler returns
+	lastScaleUp time.Time
+	lastScale   time.Time
+
+	// the scale ups are retried after retryAt when failures machines in a
+	// row failed to be created
+	backoffMu sync.Mutex
+	failures  int
+	retryAt   time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewAutoscaler creates an autoscaler of the machines of factory, it
+// returns once opts.MinMachines machines are provided
+func NewAutoscaler(ctx context.Context, factory MachineFactory, opts AutoscalerOptions) (a *Autoscaler, err error) {
+	if opts.MinMachines < 0 || opts.MaxMachines > 0 && opts.MinMachines > opts.MaxMachines {
+		return nil, errors.New("gofn: autoscaler MinMachines out of bounds")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.ScaleDownCooldown <= 0 {
+		opts.ScaleDownCooldown = defaultScaleDownCooldown
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultScaleInterval
+	}
+	m, err := newMachineManager(ctx, factory, MachineManagerOptions{
+		MaxMachines: opts.MaxMachines,
+		Concurrency: opts.Concurrency,
+		StateFile:   opts.StateFile,
+		Leases:      opts.Leases,
+	}, true)
+	if err != nil {
+		return
+	}
+	a = &Autoscaler{
+		m:         m,
+		opts:      opts,
+		lastScale: time.Now(),
+		done:      make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+
+	for i := len(m.Machines()); i < opts.MinMachines; i++ {
+		err = a.add(ctx)
+		if err != nil {
+			closeErr := a.Close()
+			if closeErr != nil {
+				log.Errorln(closeErr)
+			}
+			a = nil
+			return
+		}
+	}
+	a.wg.Add(1)
+	go a.scaleLoop()
+	return
+}
+
+// Run runs the function in a machine of the autoscaler, waiting for a
+// machine to be created when every machine is busy. buildOpts.Iaas is
+// ignored and the machine which ran the function is in Result.Machine
+func (a *Autoscaler) Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (*Result, error) {
+	return a.m.Run(ctx, buildOpts, containerOpts)
+}
+
+// RunStream runs the function like Run, but writes its output to stdout and
+// stderr while it is produced
+func (a *Autoscaler) RunStream(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (*Result, error) {
+	return a.m.RunStream(ctx, buildOpts, containerOpts, stdout, stderr)
+}
+
+// Machines returns the machines of the autoscaler
+func (a *Autoscaler) Machines() []ManagedMachine {
+	return a.m.Machines()
+}
+
+// Stats returns the current machines and invocations
+func (a *Autoscaler) Stats() AutoscalerStats {
+	a.m.mu.Lock()
+	defer a.m.mu.Unlock()
+	stats := AutoscalerStats{
+		Machines: len(a.m.machines),
+		Creating: a.m.creating,
+		Pending:  a.m.waiting,
+	}
+	for _, mm := range a.m.machines {
+		stats.Running += mm.running
+	}
+	return stats
+}
+
+// Close stops scaling and deletes the machines, it waits for the machines
+// being created to delete them too. Machines still running invocations are
+// deleted when they finish
+func (a *Autoscaler) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	a.cancel()
+	a.wg.Wait()
+	return a.m.Close()
+}
+
+func (a *Autoscaler) scaleLoop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			a.scale(now)
+		case <-a.m.wake:
+			a.scale(time.Now())
+		}
+	}
+}
+
+// scale creates or deletes machines to run the running and pending
+// invocations with opts.Concurrency invocations in each machine
+func (a *Autoscaler) scale(now time.Time) {
+	m := a.m
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	demand := m.waiting
+	for _, mm := range m.machines {
+		demand += mm.running
+	}
+	current := len(m.machines) + m.creating
+	m.mu.Unlock()
+
+	desired := (demand + a.opts.Concurrency - 1) / a.opts.Concurrency
+	if desired < a.opts.MinMachines {
+		desired = a.opts.MinMachines
+	}
+	if a.opts.MaxMachines > 0 && desired > a.opts.MaxMachines {
+		desired = a.opts.MaxMachines
+	}
+	switch {
+	case desired > current:
+		if !a.lastScaleUp.IsZero() && now.Sub(a.lastScaleUp) < a.opts.ScaleUpCooldown {
+			return
+		}
+		a.backoffMu.Lock()
+		retryAt := a.retryAt
+		a.backoffMu.Unlock()
+		if now.Before(retryAt) {
+			return
+		}
+		log.Debugf("scaling up from %v to %v machines\n", current, desired)
+		a.lastScaleUp, a.lastScale = now, now
+		for i := current; i < desired; i++ {
+			a.grow()
+		}
+	case desired < current:
+		if now.Sub(a.lastScale) < a.opts.ScaleDownCooldown {
+			return
+		}
+		if a.shrink(current-desired) > 0 {
+			a.lastScale = now
+		}
+	}
+}
+
+// grow creates a machine in background, it is counted as being created
+// before grow returns so the next scale does not create it again
+func (a *Autoscaler) grow() {
+	a.m.mu.Lock()
+	a.m.creating++
+	a.m.mu.Unlock()
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		// a canceled create would return before the machine exists and
+		// delete it in background, after Close returned
+		_, err := a.m.create(context.Background(), 0)
+		if err != nil {
+			log.Errorf("error trying to scale up %v\n", err)
+		}
+		a.created(err)
+	}()
+}
+
+// created updates the backoff of the scale ups after a machine is created
+// or fails to be
+func (a *Autoscaler) created(err error) {
+	a.backoffMu.Lock()
+	defer a.backoffMu.Unlock()
+	if err == nil {
+		a.failures = 0
+		a.retryAt = time.Time{}
+		return
+	}
+	backoff := minScaleUpBackoff
+	for i := 0; i < a.failures && backoff < maxScaleUpBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxScaleUpBackoff {
+		backoff = maxScaleUpBackoff
+	}
+	a.failures++
+	a.retryAt = time.Now().Add(backoff)
+}
+
+// add creates a machine without invocations
+func (a *Autoscaler) add(ctx context.Context) error {
+	a.m.mu.Lock()
+	a.m.creating++
+	a.m.mu.Unlock()
+	_, err := a.m.create(ctx, 0)
+	return err
+}
+
+// shrink deletes up to n idle machines, the least recently used first, and
+// returns how many were deleted. Machines running gofn containers are kept
+func (a *Autoscaler) shrink(n int) (deleted int) {
+	m := a.m
+	m.mu.Lock()
+	var idle []*managedMachine
+	for _, mm := range m.machines {
+		if mm.running == 0 && !mm.draining {
+			idle = append(idle, mm)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].lastUsed.Before(idle[j].lastUsed)
+	})
+	if len(idle) > n {
+		idle = idle[:n]
+	}
+	for _, mm := range idle {
+		mm.draining = true
+	}
+	m.mu.Unlock()
+
+	for _, mm := range idle {
+		busy, err := runningContainers(a.ctx, mm.rt)
+		if err != nil {
+			log.Errorf("error trying to list the containers of machine %v: %v\n", mm.machine.ID, err)
+		}
+		m.mu.Lock()
+		mm.draining = false
+		remove := err == nil && !busy && m.has(mm)
+		if remove {
+			m.remove([]*managedMachine{mm})
+			saveErr := m.save()
+			if saveErr != nil {
+				log.Errorf("error trying to save the machines %v\n", saveErr)
+			}
+		}
+		// the machine takes invocations again or the cap allows another one
+		m.signal()
+		m.mu.Unlock()
+
+		if remove && m.discard(mm) == nil {
+			deleted++
+		}
+	}
+	return
+}
+
+// runningContainers reports whether gofn containers run in rt, they may
+// belong to invocations of other processes
+func runningContainers(ctx context.Context, rt provision.Runtime) (bool, error) {
+	containers, err := rt.ListContainers(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range containers {
+		if c.State.Running {
+			return true, nil
+		}
+	}
+	return false, nil
+}
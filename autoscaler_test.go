@@ -0,0 +1,201 @@
+package gofn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/provision"
+)
+
+func TestAutoscalerScaleUp(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	a, err := NewAutoscaler(context.Background(), factory, AutoscalerOptions{
+		MinMachines: 1,
+		MaxMachines: 3,
+		Concurrency: 2,
+		Interval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer a.Close()
+	if created, _, _ := factory.count(); created != 1 {
+		t.Errorf("expected the minimum of machines to be created but found %d", created)
+	}
+
+	// the pending invocations wake the autoscaler
+	acquired := make(chan *managedMachine)
+	for i := 0; i < 6; i++ {
+		go func() {
+			mm, _ := a.m.acquire(context.Background())
+			acquired <- mm
+		}()
+	}
+	running := make(map[*managedMachine]int)
+	for i := 0; i < 6; i++ {
+		select {
+		case mm := <-acquired:
+			running[mm]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the invocations to run but found %+v", a.Stats())
+		}
+	}
+	if len(running) != 3 {
+		t.Errorf("expected the invocations in 3 machines but found %d", len(running))
+	}
+	for mm, n := range running {
+		if n != 2 {
+			t.Errorf("expected 2 invocations in machine %v but found %d", mm.machine.ID, n)
+		}
+	}
+	if stats := a.Stats(); stats.Machines != 3 || stats.Running != 6 || stats.Pending != 0 {
+		t.Errorf("expected 6 invocations running in 3 machines but found %+v", stats)
+	}
+	for mm, n := range running {
+		for i := 0; i < n; i++ {
+			a.m.release(mm)
+		}
+	}
+}
+
+func TestAutoscalerScaleDown(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	a, err := NewAutoscaler(context.Background(), factory, AutoscalerOptions{
+		MinMachines:       1,
+		MaxMachines:       3,
+		ScaleDownCooldown: time.Minute,
+		Interval:          time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer a.Close()
+	for i := 0; i < 2; i++ {
+		if err = a.add(context.Background()); err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+	}
+
+	// an invocation keeps its machine
+	mm, err := a.m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	a.scale(time.Now())
+	if n := len(a.Machines()); n != 3 {
+		t.Errorf("expected no scale down within the cooldown but found %d machines", n)
+	}
+
+	// so does a gofn container of another process
+	client, err := docker.NewClient(factory.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PullImage(docker.PullImageOptions{Repository: "gofn/python"}, docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := provision.FnContainer(client, provision.ContainerOptions{Image: "gofn/python"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.StartContainer(container.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.scale(time.Now().Add(time.Hour))
+	if n := len(a.Machines()); n != 3 {
+		t.Errorf("expected the machines running containers to be kept but found %d machines", n)
+	}
+
+	if err = client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	a.scale(time.Now().Add(2 * time.Hour))
+	machines := a.Machines()
+	if len(machines) != 1 || machines[0].Machine.ID != mm.machine.ID {
+		t.Errorf("expected the idle machines deleted but found %+v", machines)
+	}
+	a.m.release(mm)
+	a.scale(time.Now().Add(3 * time.Hour))
+	if n := len(a.Machines()); n != 1 {
+		t.Errorf("expected the minimum of machines to be kept but found %d", n)
+	}
+	if _, _, deleted := factory.count(); deleted != 2 {
+		t.Errorf("expected 2 machines deleted but found %d", deleted)
+	}
+}
+
+func TestAutoscalerScaleUpBackoff(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	factory.failNew = errors.New("no capacity")
+	a, err := NewAutoscaler(context.Background(), factory, AutoscalerOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer a.Close()
+
+	// the invocations waiting for a machine do not retry the failed scale up
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := a.m.acquire(ctx); err == nil {
+				t.Error("expected no machine to be acquired")
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	factory.mu.Lock()
+	attempts := factory.next
+	factory.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("expected a single scale up before the backoff but found %d", attempts)
+	}
+}
+
+func TestAutoscalerCloseWhileCreating(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	a, err := NewAutoscaler(context.Background(), factory, AutoscalerOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	creating := make(chan struct{})
+	factory.mu.Lock()
+	factory.creating = creating
+	factory.mu.Unlock()
+	a.grow()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- a.Close()
+	}()
+	select {
+	case err = <-closed:
+		t.Fatalf("expected Close to wait for the machine being created but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(creating)
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to return once the machine is created")
+	}
+	if created, _, deleted := factory.count(); created != 1 || deleted != 1 {
+		t.Errorf("expected the machine being created to be deleted but found %d created and %d deleted", created, deleted)
+	}
+}
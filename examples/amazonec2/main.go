@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/gofn/gofn"
 	"github.com/gofn/gofn/iaas/amazonec2"
@@ -17,9 +18,10 @@ func main() {
 		Dockerfile: "Dockerfile",
 		ImageName:  "gofn-example-1",
 		RemoteURI:  "",
-		StdIN:      `{"a": 10, "b": 20}`,
 	}
-	containerOpts := &provision.ContainerOptions{}
+	containerOpts := &provision.ContainerOptions{
+		Stdin: strings.NewReader(`{"a": 10, "b": 20}`),
+	}
 	accessKey := os.Getenv("AWS_ACCESS_KEY")
 	secretKey := os.Getenv("AWS_SECRET_KEY")
 	if accessKey == "" {
@@ -34,9 +36,10 @@ func main() {
 	}
 	buildOpts.Iaas = p
 
-	stdout, _, err := gofn.Run(context.Background(), buildOpts, containerOpts)
+	result, err := gofn.Run(context.Background(), buildOpts, containerOpts)
 	if err != nil {
 		log.Println(err)
+		return
 	}
-	fmt.Println("Stdout: ", stdout)
+	fmt.Println("Stdout: ", result.Stdout)
 }
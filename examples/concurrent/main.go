@@ -6,8 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
-
-	"sync"
+	"strings"
 
 	"github.com/gofn/gofn"
 	"github.com/gofn/gofn/iaas/digitalocean"
@@ -17,7 +16,6 @@ import (
 const parallels = 3
 
 func main() {
-	wait := &sync.WaitGroup{}
 	contextDir := flag.String("contextDir", "./", "a string")
 	dockerfile := flag.String("dockerfile", "Dockerfile", "a string")
 	imageName := flag.String("imageName", "", "a string")
@@ -27,22 +25,43 @@ func main() {
 	remoteBuild := flag.Bool("remoteBuild", false, "true or false")
 	input := flag.String("input", "", "a string")
 	flag.Parse()
-	wait.Add(parallels)
+	executor := gofn.NewExecutor(gofn.ExecutorOptions{MaxConcurrency: parallels, QueueSize: parallels})
+	ctx := context.Background()
+	var futures []*gofn.Future
 	for i := 0; i < parallels; i++ {
-		run(*contextDir, *dockerfile, *imageName, *remoteBuildURI, *volumeSource, *volumeDestination, wait, *remoteBuild, *input)
+		buildOpts, containerOpts := options(*contextDir, *dockerfile, *imageName, *remoteBuildURI, *volumeSource, *volumeDestination, *remoteBuild, *input)
+		future, err := executor.Submit(ctx, buildOpts, containerOpts)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		result, err := future.Wait(ctx)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Println("Stderr: ", result.Stderr)
+		fmt.Println("Stdout: ", result.Stdout)
+	}
+	err := executor.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
 	}
-	wait.Wait()
 }
 
-func run(contextDir, dockerfile, imageName, remoteBuildURI, volumeSource, volumeDestination string, wait *sync.WaitGroup, remote bool, input string) {
+func options(contextDir, dockerfile, imageName, remoteBuildURI, volumeSource, volumeDestination string, remote bool, input string) (*provision.BuildOptions, *provision.ContainerOptions) {
 	buildOpts := &provision.BuildOptions{
 		ContextDir: contextDir,
 		Dockerfile: dockerfile,
 		ImageName:  imageName,
 		RemoteURI:  remoteBuildURI,
-		StdIN:      input,
 	}
-	containerOpts := &provision.ContainerOptions{}
+	containerOpts := &provision.ContainerOptions{
+		Stdin: strings.NewReader(input),
+	}
 	if volumeSource != "" {
 		if volumeDestination == "" {
 			volumeDestination = volumeSource
@@ -59,15 +78,6 @@ func run(contextDir, dockerfile, imageName, remoteBuildURI, volumeSource, volume
 			log.Println(err)
 		}
 		buildOpts.Iaas = do
-
 	}
-	go func() {
-		defer wait.Done()
-		stdout, stderr, err := gofn.Run(context.Background(), buildOpts, containerOpts)
-		if err != nil {
-			log.Println(err)
-		}
-		fmt.Println("Stderr: ", stderr)
-		fmt.Println("Stdout: ", stdout)
-	}()
+	return buildOpts, containerOpts
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/gofn/gofn"
 	"github.com/gofn/gofn/iaas"
@@ -18,9 +19,10 @@ func main() {
 		Dockerfile: "Dockerfile",
 		ImageName:  "gofn-example-1",
 		RemoteURI:  "",
-		StdIN:      `{"a": 10, "b": 20}`,
 	}
-	containerOpts := &provision.ContainerOptions{}
+	containerOpts := &provision.ContainerOptions{
+		Stdin: strings.NewReader(`{"a": 10, "b": 20}`),
+	}
 	project := os.Getenv("GOOGLE_PROJECT")
 	credentials := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 	if project == "" {
@@ -38,9 +40,10 @@ func main() {
 	}
 	buildOpts.Iaas = p
 
-	stdout, _, err := gofn.Run(context.Background(), buildOpts, containerOpts)
+	result, err := gofn.Run(context.Background(), buildOpts, containerOpts)
 	if err != nil {
 		log.Println(err)
+		return
 	}
-	fmt.Println("Stdout: ", stdout)
+	fmt.Println("Stdout: ", result.Stdout)
 }
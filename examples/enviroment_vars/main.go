@@ -18,10 +18,11 @@ func main() {
 		Env: []string{"FOO=bar", "KEY=value"},
 		Cmd: []string{"env"},
 	}
-	stdout, stderr, err := gofn.Run(context.Background(), buildOpts, containerOpts)
+	result, err := gofn.Run(context.Background(), buildOpts, containerOpts)
 	if err != nil {
 		log.Println(err)
+		return
 	}
-	fmt.Println("Stderr: ", stderr)
-	fmt.Println("Stdout: ", stdout)
+	fmt.Println("Stderr: ", result.Stderr)
+	fmt.Println("Stdout: ", result.Stdout)
 }
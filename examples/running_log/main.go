@@ -26,7 +26,8 @@ func main() {
 		log.Fatal(err)
 	}
 	defer iaas.DeleteMachine()
-	container, err := gofn.PrepareContainer(ctx, client, &provision.BuildOptions{
+	rt := provision.NewDockerRuntime(client)
+	container, err := gofn.PrepareContainer(ctx, rt, &provision.BuildOptions{
 		ContextDir: "testDocker",
 		Dockerfile: "Dockerfile",
 		ImageName:  "python",
@@ -35,12 +36,14 @@ func main() {
 		log.Println(err)
 		return
 	}
-	errors, err := gofn.RunWait(ctx, client, container)
+	defer gofn.DestroyContainer(ctx, rt, container)
+	// attach before starting so that no output is lost
+	w, err := gofn.Attach(ctx, rt, container, nil, os.Stdout, os.Stderr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	_, err = gofn.Attach(ctx, client, container, nil, os.Stdout, os.Stderr)
+	errors, err := gofn.RunWait(ctx, rt, container)
 	if err != nil {
 		log.Println(err)
 		return
@@ -49,4 +52,5 @@ func main() {
 	if err != nil {
 		log.Println(err)
 	}
+	w.Wait()
 }
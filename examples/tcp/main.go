@@ -12,6 +12,7 @@ import (
 
 func main() {
 	// example: docker.gofn.io:2375
+	// with TLS: tcp.New("tcps://<your.hosting.com>:2376", tcp.WithCertsDir("/path/to/certs"))
 	tcp, err := tcp.New("tcp://<your.hosting.com>:2375")
 	if err != nil {
 		log.Println(err)
@@ -23,11 +24,11 @@ func main() {
 		Iaas:       tcp,
 	}
 	containerOpts := &provision.ContainerOptions{}
-	stdout, stderr, err := gofn.Run(context.Background(), buildOpts, containerOpts)
+	result, err := gofn.Run(context.Background(), buildOpts, containerOpts)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	fmt.Println("Stderr: ", stderr)
-	fmt.Println("Stdout: ", stdout)
+	fmt.Println("Stderr: ", result.Stderr)
+	fmt.Println("Stdout: ", result.Stdout)
 }
\ No newline at end of file
@@ -0,0 +1,253 @@
+package gofn
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/gofn/gofn/provision"
+)
+
+var (
+	// ErrQueueFull is returned by Executor.Submit when the queue has no room for another job
+	ErrQueueFull = errors.New("gofn: executor queue full")
+
+	// ErrExecutorClosed is returned by Executor.Submit after Shutdown or Close
+	ErrExecutorClosed = errors.New("gofn: executor closed")
+)
+
+// ExecutorOptions configures an Executor
+type ExecutorOptions struct {
+	// MaxConcurrency is the number of functions running at the same time,
+	// the number of CPUs when it is zero
+	MaxConcurrency int
+	// QueueSize is the number of submitted jobs waiting to run, Submit
+	// fails with ErrQueueFull when it is reached
+	QueueSize int
+	// Runtime runs the functions, the local Docker daemon or the machine
+	// given in BuildOptions.Iaas is used when it is nil
+	Runtime provision.Runtime
+}
+
+// Future is the pending result of a job submitted to an Executor
+type Future struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// Done is closed when the job finishes
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits the job to finish and returns what Run returned for it, it
+// returns ErrCanceled or ErrDeadlineExceeded when ctx is done first without
+// canceling the job
+func (f *Future) Wait(ctx context.Context) (*Result, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, contextError(ctx, ctx.Err())
+	}
+}
+
+type job struct {
+	ctx           context.Context
+	buildOpts     *provision.BuildOptions
+	containerOpts *provision.ContainerOptions
+	future        *Future
+	// dequeued is closed when a worker takes the job
+	dequeued chan struct{}
+}
+
+// Executor runs functions with bounded concurrency, jobs wait in a bounded
+// queue and are rejected when it is full. Use one Executor per Docker host
+// to limit the load of each host
+type Executor struct {
+	run func(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (*Result, error)
+
+	queueSize int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	mu    sync.Mutex
+	ready *sync.Cond
+	queue []*job
+	// waiting counts the workers waiting for a job, they take jobs
+	// besides the ones the queue holds
+	waiting int
+	closed  bool
+}
+
+// NewExecutor creates an Executor and starts its workers
+func NewExecutor(opts ExecutorOptions) *Executor {
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = runtime.NumCPU()
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
+	e := &Executor{
+		run:       Run,
+		queueSize: opts.QueueSize,
+	}
+	e.ready = sync.NewCond(&e.mu)
+	if opts.Runtime != nil {
+		e.run = func(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (*Result, error) {
+			return RunWithRuntime(ctx, opts.Runtime, buildOpts, containerOpts)
+		}
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.wg.Add(opts.MaxConcurrency)
+	for i := 0; i < opts.MaxConcurrency; i++ {
+		go e.worker()
+	}
+	return e
+}
+
+// Submit queues the function to run with ctx, canceling ctx also removes a
+// queued job, whose Future finishes with ErrCanceled or ErrDeadlineExceeded.
+// It does not block, ErrQueueFull is returned when every worker is busy and
+// the queue is full
+func (e *Executor) Submit(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (*Future, error) {
+	j := &job{
+		ctx:           ctx,
+		buildOpts:     buildOpts,
+		containerOpts: containerOpts,
+		future:        &Future{done: make(chan struct{})},
+		dequeued:      make(chan struct{}),
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrExecutorClosed
+	}
+	if len(e.queue) >= e.queueSize+e.waiting {
+		return nil, ErrQueueFull
+	}
+	e.queue = append(e.queue, j)
+	e.ready.Signal()
+	if ctx.Done() != nil {
+		go e.watch(j)
+	}
+	return j.future, nil
+}
+
+// watch removes the job from the queue when its context is done before a
+// worker takes it
+func (e *Executor) watch(j *job) {
+	select {
+	case <-j.ctx.Done():
+	case <-j.dequeued:
+		return
+	}
+	e.mu.Lock()
+	removed := false
+	for i, queued := range e.queue {
+		if queued == j {
+			e.queue = append(e.queue[:i], e.queue[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	e.mu.Unlock()
+	if removed {
+		j.future.err = contextError(j.ctx, j.ctx.Err())
+		close(j.future.done)
+	}
+}
+
+// Shutdown stops accepting jobs and waits the queued and running ones to
+// finish. When ctx is done first the remaining jobs are canceled and
+// Shutdown returns after they stop
+func (e *Executor) Shutdown(ctx context.Context) error {
+	e.closeQueue()
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-done
+		return contextError(ctx, ctx.Err())
+	}
+}
+
+// Close stops accepting jobs, cancels the queued and running ones and
+// waits them to stop
+func (e *Executor) Close() error {
+	e.closeQueue()
+	e.cancel()
+	e.wg.Wait()
+	return nil
+}
+
+func (e *Executor) closeQueue() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.ready.Broadcast()
+}
+
+func (e *Executor) worker() {
+	defer e.wg.Done()
+	for {
+		j := e.next()
+		if j == nil {
+			return
+		}
+		e.execute(j)
+	}
+}
+
+// next waits for a queued job, it returns nil once the executor is closed
+// and its queue is empty
+func (e *Executor) next() *job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.waiting++
+	for len(e.queue) == 0 && !e.closed {
+		e.ready.Wait()
+	}
+	e.waiting--
+	if len(e.queue) == 0 {
+		return nil
+	}
+	j := e.queue[0]
+	e.queue[0] = nil
+	e.queue = e.queue[1:]
+	close(j.dequeued)
+	return j
+}
+
+func (e *Executor) execute(j *job) {
+	defer close(j.future.done)
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+	// the job is canceled by its own context or by closing the executor
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-e.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	if ctx.Err() != nil {
+		j.future.err = contextError(ctx, ctx.Err())
+		return
+	}
+	j.future.result, j.future.err = e.run(ctx, j.buildOpts, j.containerOpts)
+}
@@ -0,0 +1,165 @@
+package gofn
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+)
+
+// blockingRun returns a run function that blocks until release is closed or
+// ctx is done and records how many runs were in flight at the same time
+func blockingRun(release chan struct{}, running, maxRunning *int32) func(context.Context, *provision.BuildOptions, *provision.ContainerOptions) (*Result, error) {
+	return func(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (*Result, error) {
+		n := atomic.AddInt32(running, 1)
+		defer atomic.AddInt32(running, -1)
+		for {
+			max := atomic.LoadInt32(maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(maxRunning, max, n) {
+				break
+			}
+		}
+		select {
+		case <-release:
+			return &Result{Stdout: buildOpts.ImageName}, nil
+		case <-ctx.Done():
+			return nil, contextError(ctx, ctx.Err())
+		}
+	}
+}
+
+func TestExecutorConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	var running, maxRunning int32
+	e := NewExecutor(ExecutorOptions{MaxConcurrency: 2, QueueSize: 2})
+	e.run = blockingRun(release, &running, &maxRunning)
+
+	var futures []*Future
+	for i := 0; i < 4; i++ {
+		f, err := e.Submit(context.Background(), &provision.BuildOptions{ImageName: "fn"}, nil)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		futures = append(futures, f)
+		// let the workers take the first jobs from the queue
+		if i < 2 {
+			for atomic.LoadInt32(&running) != int32(i+1) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	_, err := e.Submit(context.Background(), &provision.BuildOptions{ImageName: "fn"}, nil)
+	if err != ErrQueueFull {
+		t.Errorf("Expected %q but found %q", ErrQueueFull, err)
+	}
+
+	close(release)
+	for _, f := range futures {
+		result, err := f.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if result.Stdout != "fn" {
+			t.Errorf("expected the result of the job but found %+v", result)
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("expected 2 jobs running at the same time but found %d", maxRunning)
+	}
+
+	err = e.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	_, err = e.Submit(context.Background(), &provision.BuildOptions{}, nil)
+	if err != ErrExecutorClosed {
+		t.Errorf("Expected %q but found %q", ErrExecutorClosed, err)
+	}
+}
+
+func TestExecutorShutdownCancelsJobs(t *testing.T) {
+	release := make(chan struct{})
+	var running, maxRunning int32
+	e := NewExecutor(ExecutorOptions{MaxConcurrency: 1, QueueSize: 1})
+	e.run = blockingRun(release, &running, &maxRunning)
+
+	inFlight, err := e.Submit(context.Background(), &provision.BuildOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	for atomic.LoadInt32(&running) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	queued, err := e.Submit(context.Background(), &provision.BuildOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = e.Shutdown(ctx)
+	if err != ErrDeadlineExceeded {
+		t.Errorf("Expected %q but found %q", ErrDeadlineExceeded, err)
+	}
+	for _, f := range []*Future{inFlight, queued} {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("expected the job to be finished after Shutdown")
+		}
+		if _, err = f.Wait(context.Background()); err != ErrCanceled {
+			t.Errorf("Expected %q but found %q", ErrCanceled, err)
+		}
+	}
+}
+
+func TestFutureWaitCanceled(t *testing.T) {
+	f := &Future{done: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Wait(ctx); err != ErrCanceled {
+		t.Errorf("Expected %q but found %q", ErrCanceled, err)
+	}
+}
+
+func TestExecutorCancelQueuedJob(t *testing.T) {
+	release := make(chan struct{})
+	var running, maxRunning int32
+	e := NewExecutor(ExecutorOptions{MaxConcurrency: 1, QueueSize: 1})
+	e.run = blockingRun(release, &running, &maxRunning)
+	defer e.Close()
+
+	inFlight, err := e.Submit(context.Background(), &provision.BuildOptions{ImageName: "fn"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	for atomic.LoadInt32(&running) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	queued, err := e.Submit(ctx, &provision.BuildOptions{ImageName: "fn"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	cancel()
+
+	// the canceled job finishes without running and leaves its place
+	if _, err = queued.Wait(context.Background()); err != ErrCanceled {
+		t.Errorf("Expected %q but found %q", ErrCanceled, err)
+	}
+	next, err := e.Submit(context.Background(), &provision.BuildOptions{ImageName: "fn"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	close(release)
+	for _, f := range []*Future{inFlight, next} {
+		if _, err = f.Wait(context.Background()); err != nil {
+			t.Errorf("Expected no errors but %q found", err)
+		}
+	}
+	if maxRunning != 1 {
+		t.Errorf("expected 1 job running at a time but found %d", maxRunning)
+	}
+}
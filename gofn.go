@@ -3,8 +3,10 @@ package gofn
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -13,11 +15,62 @@ import (
 	"github.com/nuveo/log"
 )
 
-const dockerPort = 2376
+const (
+	dockerPort = 2376
 
-// ProvideMachine provisioning a machine in the cloud
+	destroyAttempts      = 3
+	destroyRetryInterval = 3 * time.Second
+)
+
+// clients keeps the clients of the daemons found in the environment, the
+// clients of the machines provided by an Iaas are not reused
+var clients = provision.NewClientCache()
+
+var (
+	// ErrCanceled is returned by Run when its context is canceled before the function finishes
+	ErrCanceled = errors.New("gofn: run canceled")
+
+	// ErrDeadlineExceeded is returned by Run when its context deadline expires before the function finishes
+	ErrDeadlineExceeded = errors.New("gofn: run deadline exceeded")
+)
+
+// Result describes a finished function run
+type Result struct {
+	ContainerID string
+	ImageID     string
+	Machine     *iaas.Machine
+	// Host is the name of the Scheduler host which ran the function
+	Host       string
+	ExitCode   int
+	OOMKilled  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Duration   time.Duration
+	// Stdout and Stderr hold the output of the function, they are empty
+	// when the output was streamed by RunStream
+	Stdout string
+	Stderr string
+}
+
+// ExitError is returned by Run when the function exits with a status
+// different of zero, Code holds that status
+type ExitError = provision.ExitError
+
+// clientProvider is implemented by the Iaas whose machines are not reached
+// with FnClient, like iaas/ssh
+type clientProvider interface {
+	DockerClient() (*docker.Client, error)
+}
+
+// ProvideMachine provisioning a machine in the cloud, it returns once the
+// machine is ready. The machine is created within ctx when service is an
+// iaas.ContextIaas
 func ProvideMachine(ctx context.Context, service iaas.Iaas) (client *docker.Client, machine *iaas.Machine, err error) {
-	machine, err = service.CreateMachine()
+	cservice := iaas.Adapt(service)
+	machine, err = cservice.CreateMachineContext(ctx)
+	if err == nil {
+		err = cservice.WaitReady(ctx)
+	}
 	if err != nil {
 		if machine != nil {
 			cerr := service.DeleteMachine()
@@ -27,24 +80,32 @@ func ProvideMachine(ctx context.Context, service iaas.Iaas) (client *docker.Clie
 		}
 		return
 	}
+	client, err = machineClient(service, machine)
+	return
+}
+
+// machineClient returns the client of the docker daemon of the machine
+func machineClient(service iaas.Iaas, machine *iaas.Machine) (*docker.Client, error) {
+	if p, ok := service.(clientProvider); ok {
+		return p.DockerClient()
+	}
 	if machine.Port == 0 {
 		machine.Port = dockerPort
 	}
 	addr := fmt.Sprintf("%s:%d", machine.IP, machine.Port)
-	client, err = provision.FnClient(addr, machine.CertsDir)
-	return
+	return provision.FnClient(addr, machine.CertsDir)
 }
 
 // PrepareContainer build an image if necessary and run the container
-func PrepareContainer(ctx context.Context, client *docker.Client, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (container *docker.Container, err error) {
-	img, err := provision.FnFindImage(client, buildOpts.GetImageName())
+func PrepareContainer(ctx context.Context, rt provision.Runtime, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (container *provision.Container, err error) {
+	img, err := rt.FindImage(ctx, buildOpts.GetImageName())
 	if err != nil && err != provision.ErrImageNotFound {
 		return
 	}
 
 	var image string
 	if img.ID == "" {
-		image, _, err = provision.FnImageBuild(client, buildOpts)
+		image, err = rt.BuildImage(ctx, buildOpts)
 		if err != nil {
 			return
 		}
@@ -56,107 +117,209 @@ func PrepareContainer(ctx context.Context, client *docker.Client, buildOpts *pro
 		containerOpts = &provision.ContainerOptions{}
 	}
 	containerOpts.Image = image
-	container, err = provision.FnContainer(client, *containerOpts)
+	container, err = rt.CreateContainer(ctx, *containerOpts)
 	return
 }
 
 // RunWait runs the conainer returning channels to control your status
-func RunWait(ctx context.Context, client *docker.Client, container *docker.Container) (errors chan error, err error) {
-	err = provision.FnStart(client, container.ID)
+func RunWait(ctx context.Context, rt provision.Runtime, container *provision.Container) (errors chan error, err error) {
+	err = rt.StartContainer(ctx, container.ID)
 	if err != nil {
 		return
 	}
-	errors = provision.FnWaitContainer(client, container.ID)
+	errors = provision.WaitContainer(ctx, rt, container.ID)
 	return
 }
 
 // Attach allow to connect into a running container and interact using stdout, stderr and stdin
-func Attach(ctx context.Context, client *docker.Client, container *docker.Container, stdin io.Reader, stdout io.Writer, stderr io.Writer) (docker.CloseWaiter, error) {
-	return provision.FnAttach(client, container.ID, stdin, stdout, stderr)
+func Attach(ctx context.Context, rt provision.Runtime, container *provision.Container, stdin io.Reader, stdout io.Writer, stderr io.Writer) (provision.CloseWaiter, error) {
+	return rt.AttachContainer(ctx, container.ID, stdin, stdout, stderr)
 }
 
-// Run runs the designed image
-func Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (stdout string, stderr string, err error) {
-	var client *docker.Client
-	var container *docker.Container
-	var machine *iaas.Machine
-	done := make(chan struct{})
-	go func(ctx context.Context, done chan struct{}) {
-		client, err = provision.FnClient("", "")
-		if err != nil {
-			done <- struct{}{}
-			return
-		}
+// Run runs the designed image. When ctx is done before the function
+// finishes, the container is killed and removed and Run returns
+// ErrCanceled or ErrDeadlineExceeded.
+// The result is not nil once the container was created, even on errors.
+// Without buildOpts.Iaas the docker daemon is found like the docker CLI
+// does, see provision.EndpointFromEnv
+func Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (result *Result, err error) {
+	return RunWithRuntime(ctx, nil, buildOpts, containerOpts)
+}
+
+// RunStream runs the designed image like Run, but writes the output of the
+// function to stdout and stderr while it is produced instead of keeping it
+// in the result
+func RunStream(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	return run(ctx, nil, buildOpts, containerOpts, stdout, stderr)
+}
+
+// RunWithRuntime runs the designed image like Run using rt instead of the
+// local Docker daemon, buildOpts.Iaas is ignored when rt is not nil
+func RunWithRuntime(ctx context.Context, rt provision.Runtime, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (result *Result, err error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	result, err = run(ctx, rt, buildOpts, containerOpts, stdout, stderr)
+	if result != nil {
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+	}
+	return
+}
+
+// RunWithClient runs the designed image like Run using client, so callers
+// can share one client and its connections between runs. buildOpts.Iaas is
+// ignored
+func RunWithClient(ctx context.Context, client *docker.Client, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (result *Result, err error) {
+	return RunWithRuntime(ctx, provision.NewDockerRuntime(client), buildOpts, containerOpts)
+}
 
-		if buildOpts.Iaas != nil {
+// RunStreamWithRuntime runs the designed image like RunStream using rt
+// instead of the local Docker daemon
+func RunStreamWithRuntime(ctx context.Context, rt provision.Runtime, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	return run(ctx, rt, buildOpts, containerOpts, stdout, stderr)
+}
+
+func run(ctx context.Context, rt provision.Runtime, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	var machine *iaas.Machine
+	if rt == nil {
+		var client *docker.Client
+		if buildOpts.Iaas == nil {
+			var endpoint provision.DockerEndpoint
+			endpoint, err = provision.EndpointFromEnv()
+			if err != nil {
+				err = contextError(ctx, err)
+				return
+			}
+			client, err = clients.Client(ctx, endpoint)
+			if err != nil {
+				err = contextError(ctx, err)
+				return
+			}
+		} else {
 			client, machine, err = ProvideMachine(ctx, buildOpts.Iaas)
 			if err != nil {
-				done <- struct{}{}
+				err = contextError(ctx, err)
 				return
 			}
+			release := holdMachine(nil, machine)
+			defer func() {
+				release()
+				log.Debugf("trying to delete machine ID:%v\n", machine.ID)
+				deleteErr := buildOpts.Iaas.DeleteMachine()
+				if deleteErr != nil {
+					err = fmt.Errorf("error trying to delete machine %v", deleteErr)
+				}
+			}()
 		}
+		rt = provision.NewDockerRuntime(client)
+	}
 
-		container, err = PrepareContainer(ctx, client, buildOpts, containerOpts)
+	if containerOpts == nil {
+		containerOpts = &provision.ContainerOptions{}
+	}
+	if containerOpts.IsolatedNetwork {
+		nrt, ok := rt.(provision.NetworkRuntime)
+		if !ok {
+			err = provision.ErrNotSupported
+			return
+		}
+		var network string
+		network, err = nrt.CreateNetwork(ctx)
 		if err != nil {
-			done <- struct{}{}
+			err = contextError(ctx, err)
 			return
 		}
+		defer func() {
+			removeErr := nrt.RemoveNetwork(context.Background(), network)
+			if removeErr != nil {
+				log.Errorf("error trying to remove network %v, %v\n", network, removeErr.Error())
+				if err == nil {
+					err = removeErr
+				}
+			}
+		}()
+		isolatedOpts := *containerOpts
+		isolatedOpts.NetworkMode = network
+		containerOpts = &isolatedOpts
+	}
 
-		var buffout *bytes.Buffer
-		var bufferr *bytes.Buffer
-
-		buffout, bufferr, err = provision.FnRun(client, container.ID, buildOpts.StdIN)
-		stdout = buffout.String()
-		stderr = bufferr.String()
-		done <- struct{}{}
-	}(ctx, done)
-	select {
-	case <-ctx.Done():
-		log.Errorf("trying to destroy container %v\n", ctx.Err())
-	case <-done:
-		log.Debugln("trying to destroy container process done")
-	}
-	if machine != nil {
-		log.Debugf("trying to delete machine ID:%v\n", machine.ID)
-		deleteErr := buildOpts.Iaas.DeleteMachine()
-		if deleteErr != nil {
-			err = fmt.Errorf("error trying to delete machine %v", deleteErr)
-		}
+	container, err := PrepareContainer(ctx, rt, buildOpts, containerOpts)
+	if err != nil {
+		err = contextError(ctx, err)
 		return
 	}
-	if client != nil && container != nil {
-		for killAttempt := 0; killAttempt < 3; killAttempt++ {
-			if killAttempt > 0 {
-				<-time.After(time.Duration(3) * time.Second)
-			}
-			_, err = provision.FnFindContainerByID(client, container.ID)
-			if err != nil {
-				if err == provision.ErrContainerNotFound {
-					err = nil
-				}
-				return
-			}
-			if container.State.Running {
-				log.Debugf("destroying container ID:%v, attempt:%v\n", container.ID, killAttempt+1)
-				err = client.KillContainer(docker.KillContainerOptions{ID: container.ID})
-				if err != nil {
-					log.Errorf("error trying to kill container %v, %v, attempt:%v\n", container.ID, err.Error(), killAttempt+1)
-				}
-			}
-			err = client.RemoveContainer(docker.RemoveContainerOptions{
-				ID:    container.ID,
-				Force: true,
-			})
-			if err != nil {
-				log.Errorf("error trying to remove container %v, %v, attempt:%v\n", container.ID, err.Error(), killAttempt+1)
-			}
+	defer func() {
+		destroyErr := destroyContainer(rt, container.ID)
+		if destroyErr != nil && err == nil {
+			err = destroyErr
 		}
-		err = fmt.Errorf("unable to kill container %v", container.ID)
+	}()
+
+	result = &Result{
+		ContainerID: container.ID,
+		Machine:     machine,
 	}
+	runOpts := *containerOpts
+	if runOpts.Stdin == nil {
+		runOpts.Stdin = strings.NewReader(buildOpts.StdIN)
+	}
+	err = provision.RunContainer(ctx, rt, container.ID, runOpts, stdout, stderr)
+	err = contextError(ctx, err)
+	inspectResult(rt, result)
 	return
 }
 
+// inspectResult fills result with the state of its finished container
+func inspectResult(rt provision.Runtime, result *Result) {
+	// the run context may be done, but the container state is still wanted
+	info, err := rt.InspectContainer(context.Background(), result.ContainerID)
+	if err != nil {
+		log.Errorf("error trying to inspect container %v, %v\n", result.ContainerID, err.Error())
+		return
+	}
+	result.ImageID = info.ImageID
+	result.ExitCode = info.State.ExitCode
+	result.OOMKilled = info.State.OOMKilled
+	result.StartedAt = info.State.StartedAt
+	result.FinishedAt = info.State.FinishedAt
+	if !result.StartedAt.IsZero() && result.FinishedAt.After(result.StartedAt) {
+		result.Duration = result.FinishedAt.Sub(result.StartedAt)
+	}
+}
+
+// contextError replaces err by ErrCanceled or ErrDeadlineExceeded when
+// it was caused by ctx being done
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return ErrCanceled
+	case context.DeadlineExceeded:
+		return ErrDeadlineExceeded
+	}
+	return err
+}
+
+// destroyContainer kills and removes the container. It does not use the
+// context of the run because it must also happen after a cancellation
+func destroyContainer(rt provision.Runtime, containerID string) (err error) {
+	for attempt := 0; attempt < destroyAttempts; attempt++ {
+		if attempt > 0 {
+			<-time.After(destroyRetryInterval)
+		}
+		log.Debugf("destroying container ID:%v, attempt:%v\n", containerID, attempt+1)
+		err = rt.RemoveContainer(context.Background(), containerID)
+		if err == nil || err == provision.ErrContainerNotFound {
+			return nil
+		}
+		log.Errorf("error trying to remove container %v, %v, attempt:%v\n", containerID, err.Error(), attempt+1)
+	}
+	return fmt.Errorf("unable to kill container %v", containerID)
+}
+
 // DestroyContainer remove by force a container
-func DestroyContainer(ctx context.Context, client *docker.Client, container *docker.Container) error {
-	return provision.FnRemove(client, container.ID)
+func DestroyContainer(ctx context.Context, rt provision.Runtime, container *provision.Container) error {
+	return rt.RemoveContainer(ctx, container.ID)
 }
@@ -2,7 +2,12 @@ package gofn
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/gofn/gofn/provision"
 )
@@ -13,9 +18,83 @@ func TestRun(t *testing.T) {
 		ContextDir: "./error_path", // this path must not exist
 		ImageName:  "testgofn",
 	}
-	_, _, err := Run(context.Background(), buildOpts, nil)
+	_, err := Run(context.Background(), buildOpts, nil)
 	if err == nil {
 		t.Fatal("Expected error but returned nil, this test must fail because the path to Dockerfile does not exist")
 	}
 
 }
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	buildOpts := &provision.BuildOptions{
+		ContextDir: "./error_path",
+		ImageName:  "testgofn",
+	}
+	_, err := Run(ctx, buildOpts, nil)
+	if err != ErrCanceled {
+		t.Fatalf("Expected %q but found %q", ErrCanceled, err)
+	}
+
+	// the cached client of the daemon is pinged again with the canceled
+	// context once it is older than the health check interval
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	host, ok := os.LookupEnv("DOCKER_HOST")
+	if err = os.Setenv("DOCKER_HOST", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if ok {
+			_ = os.Setenv("DOCKER_HOST", host)
+			return
+		}
+		_ = os.Unsetenv("DOCKER_HOST")
+	}()
+	cache := clients
+	clients = &provision.ClientCache{HealthCheckInterval: time.Nanosecond}
+	defer func() { clients = cache }()
+	endpoint, err := provision.EndpointFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clients.Client(context.Background(), endpoint); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	time.Sleep(time.Millisecond)
+	_, err = Run(ctx, buildOpts, nil)
+	if err != ErrCanceled {
+		t.Fatalf("Expected %q but found %q", ErrCanceled, err)
+	}
+}
+
+func TestContextError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	failure := errors.New("failure")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want error
+	}{
+		{"no error", canceled, nil, nil},
+		{"context alive", context.Background(), failure, failure},
+		{"canceled", canceled, failure, ErrCanceled},
+		{"deadline exceeded", expired, failure, ErrDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contextError(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("contextError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,628 @@
+// Package gofntest provides a fake provision.Runtime to test code that runs
+// functions with gofn without a container engine.
+//
+//	rt := gofntest.NewRuntime()
+//	rt.On("gofn/hello", gofntest.Behavior{Stdout: "hello\n"})
+//	result, err := gofn.RunWithRuntime(ctx, rt, &provision.BuildOptions{ImageName: "hello"}, nil)
+//	rt.AssertCleanup(t)
+package gofntest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+)
+
+// Forever is a Behavior.Delay for containers that run until they are killed
+const Forever time.Duration = -1
+
+// Behavior scripts what the containers of an image do
+type Behavior struct {
+	// Stdout and Stderr are written as soon as the container starts
+	Stdout string
+	Stderr string
+	// ExitCode is the status of the container when it exits by itself
+	ExitCode int
+	// OOMKilled marks the container as killed by out of memory, ExitCode
+	// should be set too
+	OOMKilled bool
+	// Delay is how long the container runs before exiting, use Forever for
+	// containers that only exit when killed
+	Delay time.Duration
+	// IgnoreSIGTERM keeps the container running after SIGTERM, so only
+	// SIGKILL stops it
+	IgnoreSIGTERM bool
+
+	// BuildErr, CreateErr and StartErr make the matching operation fail
+	BuildErr  error
+	CreateErr error
+	StartErr  error
+}
+
+// Call is an operation received by the Runtime
+type Call struct {
+	Method      string
+	Image       string
+	ContainerID string
+	// Signal is set for KillContainer calls
+	Signal syscall.Signal
+}
+
+type container struct {
+	info     provision.Container
+	behavior Behavior
+	removed  bool
+
+	attach *attachment
+	// stdin is what the last run read from its stdin
+	stdin   *bytes.Buffer
+	started bool
+	killed  chan syscall.Signal
+	exited  chan struct{}
+	// written is closed after the output is written to the attached streams
+	written chan struct{}
+	// next is the exited channel of the next run of an exited container,
+	// created when streams are attached to that run
+	next chan struct{}
+}
+
+type attachment struct {
+	r      *Runtime
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	once   sync.Once
+	closed chan struct{}
+	// exited and written are the channels of the run the streams are
+	// attached to, written is set when the run starts
+	exited  chan struct{}
+	written chan struct{}
+}
+
+func (a *attachment) Close() error {
+	a.once.Do(func() { close(a.closed) })
+	return nil
+}
+
+func (a *attachment) Wait() error {
+	select {
+	case <-a.exited:
+	case <-a.closed:
+	}
+	// the output of a started container is always written, so nothing
+	// writes to the streams after Wait returns
+	a.r.mu.Lock()
+	written := a.written
+	a.r.mu.Unlock()
+	if written != nil {
+		<-written
+	}
+	return nil
+}
+
+// Runtime is an in-memory provision.Runtime, it records every call and runs
+// containers as scripted with On. It is safe for concurrent use
+type Runtime struct {
+	mu         sync.Mutex
+	behaviors  map[string][]Behavior
+	images     map[string]string
+	containers map[string]*container
+	order      []string
+	networks   map[string]provision.Network
+	calls      []Call
+	next       int
+}
+
+var _ provision.NetworkRuntime = &Runtime{}
+
+// NewRuntime creates a Runtime whose containers exit with status zero and
+// no output until other behavior is set with On
+func NewRuntime() *Runtime {
+	return &Runtime{
+		behaviors:  make(map[string][]Behavior),
+		images:     make(map[string]string),
+		containers: make(map[string]*container),
+		networks:   make(map[string]provision.Network),
+	}
+}
+
+// On scripts the containers of image, the name given by
+// BuildOptions.GetImageName. Each container, or build failing with
+// BuildErr, takes the next behavior and the last one is kept for the
+// remaining containers, so retries can be tested with a failure followed by
+// a success
+func (r *Runtime) On(image string, behaviors ...Behavior) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.behaviors[image] = behaviors
+}
+
+// AddImage makes the image available without building it
+func (r *Runtime) AddImage(image string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addImage(image)
+}
+
+// AddNetwork adds the network as if another process created it, it must be
+// removed
+func (r *Runtime) AddNetwork(network provision.Network) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.networks[network.Name] = network
+}
+
+// Calls returns the calls received so far in order
+func (r *Runtime) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]Call, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+// CallCount returns how many times method was called
+func (r *Runtime) CallCount(method string) (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		if call.Method == method {
+			n++
+		}
+	}
+	return
+}
+
+// Stdin returns what was written to the stdin of the container, also after
+// it is removed
+func (r *Runtime) Stdin(containerID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.containers[containerID]
+	if !ok {
+		return ""
+	}
+	if c.stdin == nil {
+		return ""
+	}
+	return c.stdin.String()
+}
+
+// AssertCleanup reports an error to t for each container or network that
+// was not removed
+func (r *Runtime) AssertCleanup(t testing.TB) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range r.order {
+		c := r.containers[id]
+		if !c.removed {
+			t.Errorf("gofntest: container %v of image %v was not removed", id, c.info.Image)
+		}
+	}
+	for name := range r.networks {
+		t.Errorf("gofntest: network %v was not removed", name)
+	}
+}
+
+// BuildImage records the image as built
+func (r *Runtime) BuildImage(ctx context.Context, opts *provision.BuildOptions) (string, error) {
+	name := opts.GetImageName()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "BuildImage", Image: name})
+	b := r.peek(name)
+	if b.BuildErr != nil {
+		r.take(name)
+		return "", b.BuildErr
+	}
+	r.addImage(name)
+	return name, ctx.Err()
+}
+
+// PullImage records the image as pulled
+func (r *Runtime) PullImage(ctx context.Context, opts *provision.BuildOptions) error {
+	name := opts.GetImageName()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "PullImage", Image: name})
+	r.addImage(name)
+	return ctx.Err()
+}
+
+// FindImage returns provision.ErrImageNotFound until the image is built,
+// pulled or added
+func (r *Runtime) FindImage(ctx context.Context, name string) (provision.Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "FindImage", Image: name})
+	id, ok := r.images[name]
+	if !ok {
+		return provision.Image{}, provision.ErrImageNotFound
+	}
+	return provision.Image{ID: id, Name: name}, nil
+}
+
+// CreateContainer creates a container with the next behavior of its image
+func (r *Runtime) CreateContainer(ctx context.Context, opts provision.ContainerOptions) (*provision.Container, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "CreateContainer", Image: opts.Image})
+	b := r.take(opts.Image)
+	if b.CreateErr != nil {
+		return nil, b.CreateErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.next++
+	c := &container{
+		info: provision.Container{
+			ID:      fmt.Sprintf("gofntest-%d", r.next),
+			Name:    fmt.Sprintf("gofn-%d", r.next),
+			Image:   opts.Image,
+			ImageID: r.images[opts.Image],
+			Created: time.Now(),
+			Labels:  provision.ContainerLabels(opts, fmt.Sprintf("gofntest-%d", r.next)),
+		},
+		behavior: b,
+		killed:   make(chan syscall.Signal, 2),
+		exited:   make(chan struct{}),
+	}
+	r.containers[c.info.ID] = c
+	r.order = append(r.order, c.info.ID)
+	info := c.info
+	return &info, nil
+}
+
+// StartContainer starts the container, it writes the scripted output and
+// exits after the scripted delay. An exited container runs again with the
+// same behavior, like a restarted docker container
+func (r *Runtime) StartContainer(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "StartContainer", Image: c.info.Image, ContainerID: containerID})
+	if err != nil {
+		return err
+	}
+	if c.behavior.StartErr != nil {
+		return c.behavior.StartErr
+	}
+	if c.info.State.Running {
+		return fmt.Errorf("gofntest: container %v already running", containerID)
+	}
+	if c.started {
+		if c.next == nil {
+			c.next = make(chan struct{})
+		}
+		c.exited = c.next
+		c.next = nil
+		c.killed = make(chan syscall.Signal, 2)
+		c.info.State = provision.ContainerState{}
+	}
+	c.started = true
+	c.info.State.Running = true
+	c.info.State.StartedAt = time.Now()
+	c.written = make(chan struct{})
+	a := c.attach
+	c.attach = nil
+	if a != nil {
+		a.written = c.written
+	}
+	go r.run(c, a, c.killed, c.exited, c.written)
+	return nil
+}
+
+// AttachContainer attaches the streams, the output is written to them when
+// the container starts. The streams of an exited container are attached to
+// its next run
+func (r *Runtime) AttachContainer(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (provision.CloseWaiter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "AttachContainer", Image: c.info.Image, ContainerID: containerID})
+	if err != nil {
+		return nil, err
+	}
+	a := &attachment{
+		r:      r,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		closed: make(chan struct{}),
+	}
+	switch {
+	case c.info.State.Running:
+		a.exited = c.exited
+		a.written = c.written
+	case c.started:
+		if c.next == nil {
+			c.next = make(chan struct{})
+		}
+		a.exited = c.next
+		c.attach = a
+	default:
+		a.exited = c.exited
+		c.attach = a
+	}
+	return a, nil
+}
+
+// WaitContainer waits the container to exit
+func (r *Runtime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	r.mu.Lock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "WaitContainer", Image: c.info.Image, ContainerID: containerID})
+	exited := c.exited
+	r.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return c.info.State.ExitCode, nil
+}
+
+// InspectContainer returns the state of the container
+func (r *Runtime) InspectContainer(ctx context.Context, containerID string) (*provision.Container, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "InspectContainer", Image: c.info.Image, ContainerID: containerID})
+	if err != nil {
+		return nil, err
+	}
+	info := c.info
+	return &info, nil
+}
+
+// Logs writes the scripted output of a started container
+func (r *Runtime) Logs(ctx context.Context, containerID string, stdout io.Writer, stderr io.Writer) error {
+	r.mu.Lock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "Logs", Image: c.info.Image, ContainerID: containerID})
+	r.mu.Unlock()
+	if err != nil || !c.started {
+		return err
+	}
+	if stdout != nil {
+		_, err = io.WriteString(stdout, c.behavior.Stdout)
+	}
+	if err == nil && stderr != nil {
+		_, err = io.WriteString(stderr, c.behavior.Stderr)
+	}
+	return err
+}
+
+// KillContainer sends the signal to the container, SIGTERM stops it unless
+// the behavior ignores it and SIGKILL always does
+func (r *Runtime) KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "KillContainer", Image: c.info.Image, ContainerID: containerID, Signal: signal})
+	if err != nil {
+		return err
+	}
+	if c.info.State.Running {
+		select {
+		case c.killed <- signal:
+		default:
+		}
+	}
+	return nil
+}
+
+// RemoveContainer kills the container when it is running and removes it
+func (r *Runtime) RemoveContainer(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	c, err := r.container(containerID)
+	r.record(Call{Method: "RemoveContainer", Image: c.info.Image, ContainerID: containerID})
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	c.removed = true
+	if !c.started {
+		// release the streams attached to a container that never ran
+		close(c.exited)
+	} else if c.info.State.Running {
+		select {
+		case c.killed <- syscall.SIGKILL:
+		default:
+		}
+	}
+	if c.next != nil {
+		// and the ones attached to a run that will not happen
+		close(c.next)
+		c.next = nil
+	}
+	exited := c.exited
+	r.mu.Unlock()
+	<-exited
+	return nil
+}
+
+// ListContainers lists the containers not removed
+func (r *Runtime) ListContainers(ctx context.Context) ([]provision.Container, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "ListContainers"})
+	var containers []provision.Container
+	for _, id := range r.order {
+		c := r.containers[id]
+		if !c.removed {
+			containers = append(containers, c.info)
+		}
+	}
+	return containers, nil
+}
+
+// CreateNetwork creates a network which must be removed
+func (r *Runtime) CreateNetwork(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "CreateNetwork"})
+	r.next++
+	name := fmt.Sprintf("gofntest-%d", r.next)
+	r.networks[name] = provision.Network{Name: name, Created: time.Now(), Labels: provision.NetworkLabels()}
+	return name, nil
+}
+
+// RemoveNetwork removes the network
+func (r *Runtime) RemoveNetwork(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "RemoveNetwork"})
+	if _, ok := r.networks[name]; !ok {
+		return fmt.Errorf("gofntest: network %v not found", name)
+	}
+	delete(r.networks, name)
+	return nil
+}
+
+// ListNetworks returns the networks not removed, by name
+func (r *Runtime) ListNetworks(ctx context.Context) ([]provision.Network, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(Call{Method: "ListNetworks"})
+	networks := make([]provision.Network, 0, len(r.networks))
+	for _, network := range r.networks {
+		networks = append(networks, network)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Name < networks[j].Name
+	})
+	return networks, nil
+}
+
+// run plays the behavior of the started container, the channels are the
+// ones of this run
+func (r *Runtime) run(c *container, a *attachment, killed chan syscall.Signal, exited, written chan struct{}) {
+	b := c.behavior
+	// the container reads its whole stdin before exiting by itself, a
+	// stdin without EOF only keeps it running until it is killed
+	var copied chan struct{}
+	if a != nil && a.stdin != nil {
+		stdin := &stdinWriter{r: r, buf: new(bytes.Buffer)}
+		r.mu.Lock()
+		c.stdin = stdin.buf
+		r.mu.Unlock()
+		copied = make(chan struct{})
+		go func() {
+			_, _ = io.Copy(stdin, a.stdin) // nolint
+			close(copied)
+		}()
+	}
+	if a != nil {
+		if a.stdout != nil {
+			_, _ = io.WriteString(a.stdout, b.Stdout) // nolint
+		}
+		if a.stderr != nil {
+			_, _ = io.WriteString(a.stderr, b.Stderr) // nolint
+		}
+	}
+	close(written)
+
+	code := b.ExitCode
+	oom := b.OOMKilled
+	var timeout <-chan time.Time
+	if b.Delay >= 0 {
+		timer := time.NewTimer(b.Delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	delayed := false
+wait:
+	for !delayed || copied != nil {
+		select {
+		case <-copied:
+			copied = nil
+		case <-timeout:
+			delayed = true
+			timeout = nil
+		case signal := <-killed:
+			if signal == syscall.SIGTERM && b.IgnoreSIGTERM {
+				continue
+			}
+			if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+				code = 128 + int(signal)
+				oom = false
+				break wait
+			}
+		}
+	}
+
+	r.mu.Lock()
+	c.info.State.Running = false
+	c.info.State.ExitCode = code
+	c.info.State.OOMKilled = oom
+	c.info.State.FinishedAt = time.Now()
+	r.mu.Unlock()
+	close(exited)
+}
+
+// stdinWriter writes the stdin of a run, which Stdin reads while the copy
+// goes on
+type stdinWriter struct {
+	r   *Runtime
+	buf *bytes.Buffer
+}
+
+func (w *stdinWriter) Write(p []byte) (int, error) {
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// container must be called with r.mu held, it returns an empty container
+// with the error so the call can still be recorded
+func (r *Runtime) container(containerID string) (*container, error) {
+	c, ok := r.containers[containerID]
+	if !ok || c.removed {
+		return &container{}, provision.ErrContainerNotFound
+	}
+	return c, nil
+}
+
+func (r *Runtime) record(call Call) {
+	r.calls = append(r.calls, call)
+}
+
+func (r *Runtime) addImage(name string) {
+	if _, ok := r.images[name]; !ok {
+		r.images[name] = fmt.Sprintf("sha256:%x", len(r.images)+1)
+	}
+}
+
+// peek returns the behavior the next container of the image will take
+func (r *Runtime) peek(image string) Behavior {
+	behaviors := r.behaviors[image]
+	if len(behaviors) == 0 {
+		return Behavior{}
+	}
+	return behaviors[0]
+}
+
+// take returns the behavior for a new container of the image
+func (r *Runtime) take(image string) Behavior {
+	b := r.peek(image)
+	if behaviors := r.behaviors[image]; len(behaviors) > 1 {
+		r.behaviors[image] = behaviors[1:]
+	}
+	return b
+}
@@ -0,0 +1,226 @@
+package gofntest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn"
+	"github.com/gofn/gofn/provision"
+)
+
+func TestRuntimeRun(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/hello", Behavior{Stdout: "hello", Stderr: "warning"})
+
+	result, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "hello"}, &provision.ContainerOptions{
+		Stdin: strings.NewReader("input"),
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout != "hello" || result.Stderr != "warning" {
+		t.Errorf("expected the scripted output but found %+v", result)
+	}
+	if result.ImageID == "" {
+		t.Errorf("expected the image ID in the result but found %+v", result)
+	}
+	if stdin := rt.Stdin(result.ContainerID); stdin != "input" {
+		t.Errorf("expected %q written to stdin but found %q", "input", stdin)
+	}
+	if n := rt.CallCount("BuildImage"); n != 1 {
+		t.Errorf("expected the image to be built once but found %d builds", n)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeExitCode(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/fail", Behavior{ExitCode: 3})
+
+	result, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "fail"}, nil)
+	exitErr, ok := err.(*gofn.ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3 but found %v", err)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("expected exit code 3 in the result but found %+v", result)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeOOMKilled(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/oom", Behavior{ExitCode: 137, OOMKilled: true})
+
+	_, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "oom"}, nil)
+	if err != provision.ErrOOMKilled {
+		t.Errorf("Expected %q but found %q", provision.ErrOOMKilled, err)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeTimeout(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/slow", Behavior{Delay: Forever, IgnoreSIGTERM: true})
+
+	_, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "slow"}, &provision.ContainerOptions{
+		Timeout:     10 * time.Millisecond,
+		StopTimeout: 10 * time.Millisecond,
+	})
+	if err != provision.ErrTimeout {
+		t.Errorf("Expected %q but found %q", provision.ErrTimeout, err)
+	}
+	var signals []syscall.Signal
+	for _, call := range rt.Calls() {
+		if call.Method == "KillContainer" {
+			signals = append(signals, call.Signal)
+		}
+	}
+	if len(signals) != 2 || signals[0] != syscall.SIGTERM || signals[1] != syscall.SIGKILL {
+		t.Errorf("expected SIGTERM followed by SIGKILL but found %v", signals)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeCanceled(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/slow", Behavior{Delay: Forever})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := gofn.RunWithRuntime(ctx, rt, &provision.BuildOptions{ImageName: "slow"}, nil)
+	if err != gofn.ErrDeadlineExceeded {
+		t.Errorf("Expected %q but found %q", gofn.ErrDeadlineExceeded, err)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeCanceledWithOpenStdin(t *testing.T) {
+	rt := NewRuntime()
+	stdin, w := io.Pipe()
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := gofn.RunWithRuntime(ctx, rt, &provision.BuildOptions{ImageName: "cat"}, &provision.ContainerOptions{Stdin: stdin})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != gofn.ErrDeadlineExceeded {
+			t.Errorf("Expected %q but found %q", gofn.ErrDeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the run to stop with its context while its stdin is open")
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeRetry(t *testing.T) {
+	errBuild := errors.New("build failed")
+	rt := NewRuntime()
+	rt.On("gofn/flaky", Behavior{BuildErr: errBuild}, Behavior{StartErr: errors.New("start failed")}, Behavior{Stdout: "ok"})
+
+	var tt = []struct {
+		err    error
+		stdout string
+	}{
+		{errBuild, ""},
+		{errors.New("start failed"), ""},
+		{nil, "ok"},
+		{nil, "ok"},
+	}
+	for i, tc := range tt {
+		result, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "flaky"}, nil)
+		if (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+			t.Errorf("run %d: Expected %v but found %v", i, tc.err, err)
+			continue
+		}
+		if err == nil && result.Stdout != tc.stdout {
+			t.Errorf("run %d: expected %q but found %q", i, tc.stdout, result.Stdout)
+		}
+	}
+	if n := rt.CallCount("BuildImage"); n != 2 {
+		t.Errorf("expected the image to be built twice but found %d builds", n)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeRestart(t *testing.T) {
+	rt := NewRuntime()
+	rt.On("gofn/hello", Behavior{Stdout: "hello"})
+	rt.AddImage("gofn/hello")
+	ctx := context.Background()
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, input := range []string{"first", "second"} {
+		stdout := new(bytes.Buffer)
+		err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{Stdin: strings.NewReader(input)}, stdout, nil)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found in run %d", err, i)
+		}
+		if stdout.String() != "hello" {
+			t.Errorf("Expected %q but found %q in run %d", "hello", stdout.String(), i)
+		}
+		if stdin := rt.Stdin(c.ID); stdin != input {
+			t.Errorf("Expected %q but found %q in run %d", input, stdin, i)
+		}
+	}
+	if err = rt.RemoveContainer(ctx, c.ID); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestRuntimeIsolatedNetwork(t *testing.T) {
+	rt := NewRuntime()
+	_, err := gofn.RunWithRuntime(context.Background(), rt, &provision.BuildOptions{ImageName: "net"}, &provision.ContainerOptions{
+		IsolatedNetwork: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if rt.CallCount("CreateNetwork") != 1 || rt.CallCount("RemoveNetwork") != 1 {
+		t.Errorf("expected the network to be created and removed but found %+v", rt.Calls())
+	}
+	rt.AssertCleanup(t)
+}
+
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func (r *recorder) Helper() {}
+
+func TestAssertCleanup(t *testing.T) {
+	rt := NewRuntime()
+	rt.AddImage("gofn/leak")
+	_, err := rt.CreateContainer(context.Background(), provision.ContainerOptions{Image: "gofn/leak"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	_, err = rt.CreateNetwork(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	r := &recorder{TB: t}
+	rt.AssertCleanup(r)
+	if len(r.errors) != 2 {
+		t.Errorf("expected the container and the network to be reported but found %v", r.errors)
+	}
+}
@@ -1,10 +1,16 @@
 package amazonec2
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/docker/machine/drivers/amazonec2"
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/drivers/rpc"
@@ -15,6 +21,14 @@ import (
 // Provider definition, represents a concrete implementation of an iaas
 type Provider struct {
 	iaas.Provider
+	// ec2 lists the instances of the region of the driver
+	ec2 ec2Client
+}
+
+// ec2Client is the part of the EC2 API used by the provider
+type ec2Client interface {
+	DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error)
 }
 
 type driverConfig struct {
@@ -118,11 +132,21 @@ func New(accessKey, secretKey string, opts ...iaas.ProviderOpts) (p *Provider, e
 		p = nil
 		return
 	}
+	// the tags are key and value pairs
+	driver.Tags = iaas.Tag + ",true"
 	data, err := json.Marshal(driver)
 	if err != nil {
 		p = nil
 		return
 	}
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion(driver.Region).
+		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")))
+	if err != nil {
+		p = nil
+		return
+	}
+	p.ec2 = ec2.New(sess)
 	p.Host, err = p.Client.NewHost(driver.DriverName(), data)
 	if err != nil {
 		p = nil
@@ -160,3 +184,65 @@ func (p *Provider) DeleteMachine() (err error) {
 	defer p.Client.Close()
 	return
 }
+
+// CreateMachineContext creates the instance like CreateMachine, it returns
+// when ctx is done and the instance is deleted once created
+func (p *Provider) CreateMachineContext(ctx context.Context) (*iaas.Machine, error) {
+	return iaas.CreateContext(ctx, p)
+}
+
+// DeleteMachineContext deletes the instance like DeleteMachine, it returns
+// when ctx is done
+func (p *Provider) DeleteMachineContext(ctx context.Context) error {
+	return iaas.DeleteContext(ctx, p)
+}
+
+// ListMachines returns the instances tagged by gofn in the region of the
+// provider which are not terminated, including the ones created by other
+// processes
+func (p *Provider) ListMachines(ctx context.Context) (machines []iaas.Machine, err error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + iaas.Tag), Values: aws.StringSlice([]string{"true"})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	}
+	for {
+		var output *ec2.DescribeInstancesOutput
+		output, err = p.ec2.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				machine := iaas.Machine{
+					ID:      aws.StringValue(instance.InstanceId),
+					IP:      aws.StringValue(instance.PublicIpAddress),
+					Image:   aws.StringValue(instance.ImageId),
+					Kind:    "amazonec2",
+					Created: aws.TimeValue(instance.LaunchTime),
+				}
+				// docker machine names the instances by their Name tag
+				for _, tag := range instance.Tags {
+					if aws.StringValue(tag.Key) == "Name" {
+						machine.Name = aws.StringValue(tag.Value)
+					}
+				}
+				machines = append(machines, machine)
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// RemoveMachine terminates an instance listed by ListMachines, which may
+// have been created by another process
+func (p *Provider) RemoveMachine(ctx context.Context, machine iaas.Machine) error {
+	_, err := p.ec2.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice([]string{machine.ID}),
+	})
+	return err
+}
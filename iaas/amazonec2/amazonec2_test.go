@@ -1,11 +1,16 @@
 package amazonec2
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/host"
@@ -80,7 +85,7 @@ func (m *myAPI) GetMachinesDir() string {
 func TestCreateMachine(t *testing.T) {
 	// error on create machine
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: libmachine.NewClient("", ""),
 		},
 	}
@@ -100,7 +105,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// error on get config
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -113,7 +118,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// sucess test
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &myAPI{},
 		},
 	}
@@ -147,7 +152,7 @@ func (r removeDriver) Remove() error {
 func TestDeleteMachine(t *testing.T) {
 	// success
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -160,7 +165,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on close will be ignored
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &deleteAPI{},
 		},
 	}
@@ -172,7 +177,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on remove
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -184,3 +189,76 @@ func TestDeleteMachine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// fakeEC2 returns its pages of instances and records the terminated ones
+type fakeEC2 struct {
+	pages      []*ec2.DescribeInstancesOutput
+	input      []*ec2.DescribeInstancesInput
+	terminated []string
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	copied := *input
+	f.input = append(f.input, &copied)
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return page, nil
+}
+
+func (f *fakeEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.terminated = append(f.terminated, aws.StringValueSlice(input.InstanceIds)...)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func TestListMachines(t *testing.T) {
+	launched := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := &fakeEC2{pages: []*ec2.DescribeInstancesOutput{
+		{
+			NextToken: aws.String("next"),
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{
+				InstanceId:      aws.String("i-1"),
+				ImageId:         aws.String("ami-1"),
+				PublicIpAddress: aws.String("111.222.333.444"),
+				LaunchTime:      &launched,
+				Tags:            []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("gofn-1")}},
+			}}}},
+		},
+		{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{
+				InstanceId: aws.String("i-2"),
+				LaunchTime: &launched,
+			}}}},
+		},
+	}}
+	p := Provider{ec2: fake}
+	machines, err := p.ListMachines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []iaas.Machine{
+		{ID: "i-1", IP: "111.222.333.444", Image: "ami-1", Kind: "amazonec2", Name: "gofn-1", Created: launched},
+		{ID: "i-2", Kind: "amazonec2", Created: launched},
+	}
+	if !reflect.DeepEqual(machines, want) {
+		t.Errorf("ListMachines() = %+v, want %+v", machines, want)
+	}
+	if len(fake.input) != 2 || fake.input[0].NextToken != nil || aws.StringValue(fake.input[1].NextToken) != "next" {
+		t.Errorf("expected the second page to be listed by the token of the first one but found %+v", fake.input)
+	}
+	if name := aws.StringValue(fake.input[0].Filters[0].Name); name != "tag:"+iaas.Tag {
+		t.Errorf("expected the instances to be filtered by the gofn tag but found %v", name)
+	}
+	var _ iaas.ContextIaas = &p
+}
+
+func TestRemoveMachine(t *testing.T) {
+	fake := &fakeEC2{}
+	p := Provider{ec2: fake}
+	err := p.RemoveMachine(context.Background(), iaas.Machine{ID: "i-1", Name: "gofn-1"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(fake.terminated) != 1 || fake.terminated[0] != "i-1" {
+		t.Errorf("expected the instance i-1 to be terminated but found %v", fake.terminated)
+	}
+}
@@ -0,0 +1,144 @@
+package iaas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nuveo/log"
+)
+
+// NamePrefix starts the names given by gofn to its machines, it tags them
+// in ListMachines
+const NamePrefix = "gofn-"
+
+// Tag is set on the machines created by the providers with tags
+const Tag = "gofn"
+
+// ErrNotSupported is returned by the operations a provider does not have
+var ErrNotSupported = errors.New("iaas: operation not supported")
+
+// Status is the state of a machine
+type Status string
+
+// Machine states
+const (
+	StatusUnknown  Status = "unknown"
+	StatusStarting Status = "starting"
+	StatusRunning  Status = "running"
+	StatusStopping Status = "stopping"
+	StatusStopped  Status = "stopped"
+	StatusError    Status = "error"
+)
+
+// ContextIaas is an Iaas whose operations take a context, it also queries
+// and controls the machine besides creating and deleting it
+type ContextIaas interface {
+	Iaas
+	CreateMachineContext(ctx context.Context) (*Machine, error)
+	DeleteMachineContext(ctx context.Context) error
+	// MachineStatus returns the state of the machine
+	MachineStatus(ctx context.Context) (Status, error)
+	// ListMachines returns the machines created by gofn
+	ListMachines(ctx context.Context) ([]Machine, error)
+	// StopMachine stops the machine without deleting it
+	StopMachine(ctx context.Context) error
+	// StartMachine starts a stopped machine and waits it to be ready
+	StartMachine(ctx context.Context) error
+	// WaitReady returns once the machine is running
+	WaitReady(ctx context.Context) error
+}
+
+// adapter is the ContextIaas of an Iaas without the context operations
+type adapter struct {
+	Iaas
+}
+
+// Adapt returns service as a ContextIaas. When it is only an Iaas, the
+// machine is ready once created and the operations it does not have
+// return ErrNotSupported
+func Adapt(service Iaas) ContextIaas {
+	if c, ok := service.(ContextIaas); ok {
+		return c
+	}
+	return adapter{service}
+}
+
+func (a adapter) CreateMachineContext(ctx context.Context) (*Machine, error) {
+	return CreateContext(ctx, a.Iaas)
+}
+
+func (a adapter) DeleteMachineContext(ctx context.Context) error {
+	return DeleteContext(ctx, a.Iaas)
+}
+
+func (a adapter) MachineStatus(ctx context.Context) (Status, error) {
+	return StatusUnknown, ErrNotSupported
+}
+
+func (a adapter) ListMachines(ctx context.Context) ([]Machine, error) {
+	return nil, ErrNotSupported
+}
+
+func (a adapter) StopMachine(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+func (a adapter) StartMachine(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+func (a adapter) WaitReady(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// CreateContext creates the machine of service, returning ctx.Err() when
+// ctx is done first. The creation is not interrupted, the machine is
+// deleted once it is created
+func CreateContext(ctx context.Context, service Iaas) (*Machine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type created struct {
+		machine *Machine
+		err     error
+	}
+	done := make(chan created, 1)
+	go func() {
+		machine, err := service.CreateMachine()
+		done <- created{machine, err}
+	}()
+	select {
+	case c := <-done:
+		return c.machine, c.err
+	case <-ctx.Done():
+		go func() {
+			c := <-done
+			if c.machine == nil {
+				return
+			}
+			err := service.DeleteMachine()
+			if err != nil {
+				log.Errorf("error trying to delete machine %v created after its context was done: %v\n", c.machine.ID, err)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// DeleteContext deletes the machine of service, returning ctx.Err() when
+// ctx is done first. The deletion goes on in background
+func DeleteContext(ctx context.Context, service Iaas) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- service.DeleteMachine()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
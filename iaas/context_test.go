@@ -0,0 +1,69 @@
+package iaas
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// legacy is an Iaas without the context operations
+type legacy struct {
+	created chan struct{}
+	deleted chan struct{}
+}
+
+func (l *legacy) CreateMachine() (*Machine, error) {
+	<-l.created
+	return &Machine{ID: "legacy"}, nil
+}
+
+func (l *legacy) DeleteMachine() error {
+	close(l.deleted)
+	return nil
+}
+
+func TestAdapt(t *testing.T) {
+	l := &legacy{created: make(chan struct{}), deleted: make(chan struct{})}
+	close(l.created)
+	service := Adapt(l)
+	ctx := context.Background()
+	machine, err := service.CreateMachineContext(ctx)
+	if err != nil || machine.ID != "legacy" {
+		t.Fatalf("expected the legacy machine but found %v, %v", machine, err)
+	}
+	if err = service.WaitReady(ctx); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if _, err = service.MachineStatus(ctx); err != ErrNotSupported {
+		t.Errorf("Expected %q but found %q", ErrNotSupported, err)
+	}
+	if _, err = service.ListMachines(ctx); err != ErrNotSupported {
+		t.Errorf("Expected %q but found %q", ErrNotSupported, err)
+	}
+	if err = service.StopMachine(ctx); err != ErrNotSupported {
+		t.Errorf("Expected %q but found %q", ErrNotSupported, err)
+	}
+	if err = service.DeleteMachineContext(ctx); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if Adapt(service) != service {
+		t.Error("expected a ContextIaas not to be adapted again")
+	}
+}
+
+func TestCreateContextCanceled(t *testing.T) {
+	l := &legacy{created: make(chan struct{}), deleted: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	machine, err := CreateContext(ctx, l)
+	if err != context.DeadlineExceeded || machine != nil {
+		t.Fatalf("Expected %q but found %v, %v", context.DeadlineExceeded, machine, err)
+	}
+	// the machine created after the deadline is deleted
+	close(l.created)
+	select {
+	case <-l.deleted:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the machine to be deleted once created")
+	}
+}
@@ -1,10 +1,14 @@
 package digitalocean
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/docker/machine/drivers/digitalocean"
 	"github.com/docker/machine/libmachine"
@@ -12,13 +16,46 @@ import (
 	"github.com/gofrs/uuid"
 )
 
+// defaultAPIURL is the DigitalOcean API used to list the droplets
+const defaultAPIURL = "https://api.digitalocean.com"
+
 // Provider definition, represents a concrete implementation of an iaas
 type Provider struct {
 	iaas.Provider
+	// token authenticates the calls to the API at apiURL, which defaults to
+	// defaultAPIURL
+	token  string
+	apiURL string
+}
+
+// droplet is a droplet of the DigitalOcean API
+type droplet struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	Image     struct {
+		Slug string `json:"slug"`
+	} `json:"image"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+}
+
+type dropletsPage struct {
+	Droplets []droplet `json:"droplets"`
+	Links    struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
 }
 
 type driverConfig struct {
-	Driver struct {
+	DriverName string `json:"DriverName"`
+	Driver     struct {
 		DropletID   int    `json:"DropletID"`
 		DropletName string `json:"DropletName"`
 		IPAddress   string `json:"IPAddress"`
@@ -41,7 +78,7 @@ func getConfig(machineDir, hostName string) (config *driverConfig, err error) {
 }
 
 func New(token string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
-	p = &Provider{}
+	p = &Provider{token: token}
 	for _, opt := range opts {
 		if err = opt(&p.Provider); err != nil {
 			p = nil
@@ -77,6 +114,7 @@ func New(token string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
 	if p.KeyID != 0 {
 		driver.SSHKeyID = p.KeyID
 	}
+	driver.Tags = iaas.Tag
 	data, err := json.Marshal(driver)
 	if err != nil {
 		p = nil
@@ -122,3 +160,82 @@ func (do *Provider) DeleteMachine() (err error) {
 	}
 	return
 }
+
+// CreateMachineContext creates the droplet like CreateMachine, it returns
+// when ctx is done and the droplet is deleted once created
+func (do *Provider) CreateMachineContext(ctx context.Context) (*iaas.Machine, error) {
+	return iaas.CreateContext(ctx, do)
+}
+
+// DeleteMachineContext deletes the droplet like DeleteMachine, it returns
+// when ctx is done
+func (do *Provider) DeleteMachineContext(ctx context.Context) error {
+	return iaas.DeleteContext(ctx, do)
+}
+
+// ListMachines returns the droplets tagged by gofn in the account of the
+// token, including the ones created by other processes
+func (do *Provider) ListMachines(ctx context.Context) (machines []iaas.Machine, err error) {
+	next := do.url("/v2/droplets?per_page=200&tag_name=" + url.QueryEscape(iaas.Tag))
+	for next != "" {
+		var page dropletsPage
+		err = do.call(ctx, http.MethodGet, next, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range page.Droplets {
+			machine := iaas.Machine{
+				ID:    strconv.Itoa(d.ID),
+				Image: d.Image.Slug,
+				Kind:  "digitalocean",
+				Name:  d.Name,
+			}
+			for _, network := range d.Networks.V4 {
+				if network.Type == "public" {
+					machine.IP = network.IPAddress
+				}
+			}
+			// the creation time is unknown when it can not be parsed
+			machine.Created, _ = time.Parse(time.RFC3339, d.CreatedAt)
+			machines = append(machines, machine)
+		}
+		next = page.Links.Pages.Next
+	}
+	return
+}
+
+// RemoveMachine deletes a droplet listed by ListMachines, which may have
+// been created by another process
+func (do *Provider) RemoveMachine(ctx context.Context, machine iaas.Machine) error {
+	return do.call(ctx, http.MethodDelete, do.url("/v2/droplets/"+url.PathEscape(machine.ID)), nil)
+}
+
+func (do *Provider) url(path string) string {
+	if do.apiURL != "" {
+		return do.apiURL + path
+	}
+	return defaultAPIURL + path
+}
+
+// call sends a request to the API and decodes its JSON answer into out
+// when it is not nil
+func (do *Provider) call(ctx context.Context, method, rawURL string, out interface{}) error {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+do.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("digitalocean: %v %v: %v", method, req.URL.Path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
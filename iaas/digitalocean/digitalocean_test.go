@@ -1,11 +1,16 @@
 package digitalocean
 
 import (
+	"context"
 	"github.com/gofn/gofn/iaas"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
@@ -27,6 +32,7 @@ func Test_getConfig(t *testing.T) {
 		{name: "config not found", args: args{machineDir: "./testdata/", hostName: "notfound"}, wantErr: true},
 		{name: "problem to parse json", args: args{machineDir: "./testdata/", hostName: "unparseable"}, wantErr: true},
 		{name: "correct parser", args: args{machineDir: "./testdata/", hostName: "testconfig"}, wantConfig: &driverConfig{
+			DriverName: "digitalocean",
 			Driver: struct {
 				DropletID   int    "json:\"DropletID\""
 				DropletName string "json:\"DropletName\""
@@ -79,7 +85,7 @@ func (m *myAPI) GetMachinesDir() string {
 func TestCreateMachine(t *testing.T) {
 	// error on create machine
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: libmachine.NewClient("", ""),
 		},
 	}
@@ -99,7 +105,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// error on get config
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -112,7 +118,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// sucess test
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &myAPI{},
 		},
 	}
@@ -146,7 +152,7 @@ func (r removeDriver) Remove() error {
 func TestDeleteMachine(t *testing.T) {
 	// success
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -159,7 +165,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on close will be ignored
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &deleteAPI{},
 		},
 	}
@@ -171,7 +177,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on remove
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -183,3 +189,81 @@ func TestDeleteMachine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestListMachines(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("tag_name") != iaas.Tag {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// the droplets are listed in two pages
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"droplets": [{"id": 1, "name": "gofn-1", "created_at": "2020-01-02T03:04:05Z",
+				"image": {"slug": "ubuntu-16-04-x64"},
+				"networks": {"v4": [{"ip_address": "10.0.0.1", "type": "private"}, {"ip_address": "111.222.333.444", "type": "public"}]}}],
+				"links": {"pages": {"next": "%v/v2/droplets?page=2&per_page=200&tag_name=gofn"}}}`, server.URL)
+			return
+		}
+		fmt.Fprint(w, `{"droplets": [{"id": 2, "name": "gofn-2", "created_at": "2020-01-02T04:04:05Z"}], "links": {}}`)
+	}))
+	defer server.Close()
+
+	p := Provider{token: "token", apiURL: server.URL}
+	machines, err := p.ListMachines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []iaas.Machine{
+		{
+			ID:      "1",
+			IP:      "111.222.333.444",
+			Image:   "ubuntu-16-04-x64",
+			Kind:    "digitalocean",
+			Name:    "gofn-1",
+			Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			ID:      "2",
+			Kind:    "digitalocean",
+			Name:    "gofn-2",
+			Created: time.Date(2020, 1, 2, 4, 4, 5, 0, time.UTC),
+		},
+	}
+	if !reflect.DeepEqual(machines, want) {
+		t.Errorf("ListMachines() = %+v, want %+v", machines, want)
+	}
+	var _ iaas.ContextIaas = &p
+
+	p.token = "invalid"
+	if _, err = p.ListMachines(context.Background()); err == nil {
+		t.Error("expecting errors for an invalid token, but nothing found")
+	}
+}
+
+func TestRemoveMachine(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p := Provider{token: "token", apiURL: server.URL}
+	err := p.RemoveMachine(context.Background(), iaas.Machine{ID: "1", Name: "gofn-1"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/v2/droplets/1" {
+		t.Errorf("expected the droplet 1 to be deleted but found %v", deleted)
+	}
+	p.token = "invalid"
+	err = p.RemoveMachine(context.Background(), iaas.Machine{ID: "1", Name: "gofn-1"})
+	if err == nil {
+		t.Error("expecting errors for an invalid token, but nothing found")
+	}
+}
@@ -1,22 +1,62 @@
 package google
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/machine/drivers/google"
 	"github.com/docker/machine/libmachine"
 	"github.com/gofn/gofn/iaas"
 	"github.com/gofrs/uuid"
+	"github.com/nuveo/log"
+	oauth "golang.org/x/oauth2/google"
+)
+
+const (
+	// defaultAPIURL is the Compute Engine API used to list the instances
+	defaultAPIURL = "https://compute.googleapis.com/compute/v1"
+	computeScope  = "https://www.googleapis.com/auth/compute"
 )
 
 // Provider definition, represents a concrete implementation of an iaas
 type Provider struct {
 	iaas.Provider
+	// project and zone are where the driver creates the instances, they
+	// are listed through the API at apiURL, which defaults to
+	// defaultAPIURL. client defaults to the one of the application
+	// default credentials
+	project string
+	zone    string
+	apiURL  string
+	client  *http.Client
+}
+
+// instance is an instance of the Compute Engine API
+type instance struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	Tags              struct {
+		Items []string `json:"items"`
+	} `json:"tags"`
+	NetworkInterfaces []struct {
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+type instancesPage struct {
+	Items         []instance `json:"items"`
+	NextPageToken string     `json:"nextPageToken"`
 }
 
 type driverConfig struct {
@@ -85,6 +125,8 @@ func New(projectID string, opts ...iaas.ProviderOpts) (p *Provider, err error) {
 	if p.DiskSize != 0 {
 		driver.DiskSize = p.DiskSize
 	}
+	p.project, p.zone = driver.Project, driver.Zone
+	driver.Tags = iaas.Tag
 	data, err := json.Marshal(driver)
 	if err != nil {
 		p = nil
@@ -113,8 +155,18 @@ func (p *Provider) CreateMachine() (machine *iaas.Machine, err error) {
 		return
 	}
 
+	var id string
+	created, err := p.instance(context.Background(), p.Name)
+	if err != nil {
+		// the instance was created, it is deleted through the store
+		log.Errorf("error trying to read the ID of instance %v: %v\n", p.Name, err)
+		err = nil
+	} else {
+		id = created.ID
+	}
+
 	machine = &iaas.Machine{
-		ID:        "",
+		ID:        id,
 		IP:        ip,
 		Image:     config.Driver.MachineImage,
 		Kind:      config.DriverName,
@@ -136,3 +188,119 @@ func (p *Provider) DeleteMachine() (err error) {
 	}
 	return
 }
+
+// CreateMachineContext creates the instance like CreateMachine, it returns
+// when ctx is done and the instance is deleted once created
+func (p *Provider) CreateMachineContext(ctx context.Context) (*iaas.Machine, error) {
+	return iaas.CreateContext(ctx, p)
+}
+
+// DeleteMachineContext deletes the instance like DeleteMachine, it returns
+// when ctx is done
+func (p *Provider) DeleteMachineContext(ctx context.Context) error {
+	return iaas.DeleteContext(ctx, p)
+}
+
+// ListMachines returns the instances named and tagged by gofn in the zone
+// of the provider, including the ones created by other processes
+func (p *Provider) ListMachines(ctx context.Context) (machines []iaas.Machine, err error) {
+	token := ""
+	for {
+		query := url.Values{"maxResults": {"500"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		var page instancesPage
+		err = p.call(ctx, http.MethodGet, p.instancesURL()+"?"+query.Encode(), &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range page.Items {
+			if !strings.HasPrefix(i.Name, iaas.NamePrefix) || !i.tagged() {
+				continue
+			}
+			machines = append(machines, i.machine())
+		}
+		token = page.NextPageToken
+		if token == "" {
+			return
+		}
+	}
+}
+
+func (i instance) tagged() bool {
+	for _, tag := range i.Tags.Items {
+		if tag == iaas.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (i instance) machine() iaas.Machine {
+	machine := iaas.Machine{
+		ID:        i.ID,
+		Kind:      "google",
+		Name:      i.Name,
+		SSHKeysID: []int{},
+	}
+	for _, network := range i.NetworkInterfaces {
+		for _, config := range network.AccessConfigs {
+			if config.NatIP != "" {
+				machine.IP = config.NatIP
+			}
+		}
+	}
+	// the creation time is unknown when it can not be parsed
+	machine.Created, _ = time.Parse(time.RFC3339, i.CreationTimestamp)
+	return machine
+}
+
+// RemoveMachine deletes an instance listed by ListMachines, which may have
+// been created by another process
+func (p *Provider) RemoveMachine(ctx context.Context, machine iaas.Machine) error {
+	return p.call(ctx, http.MethodDelete, p.instancesURL()+"/"+url.PathEscape(machine.Name), nil)
+}
+
+// instance returns the instance named name
+func (p *Provider) instance(ctx context.Context, name string) (i instance, err error) {
+	err = p.call(ctx, http.MethodGet, p.instancesURL()+"/"+url.PathEscape(name), &i)
+	return
+}
+
+func (p *Provider) instancesURL() string {
+	apiURL := p.apiURL
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	return fmt.Sprintf("%s/projects/%s/zones/%s/instances", apiURL, url.PathEscape(p.project), url.PathEscape(p.zone))
+}
+
+// call sends a request to the API and decodes its JSON answer into out
+// when it is not nil
+func (p *Provider) call(ctx context.Context, method, rawURL string, out interface{}) error {
+	client := p.client
+	if client == nil {
+		var err error
+		client, err = oauth.DefaultClient(ctx, computeScope)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("google: %v %v: %v", method, req.URL.Path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
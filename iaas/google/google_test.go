@@ -1,11 +1,16 @@
 package google
 
 import (
+	"context"
 	"github.com/gofn/gofn/iaas"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/drivers/fakedriver"
 	"github.com/docker/machine/libmachine"
@@ -88,7 +93,7 @@ func (m *myAPI) GetMachinesDir() string {
 func TestCreateMachine(t *testing.T) {
 	// error on create machine
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: libmachine.NewClient("", ""),
 		},
 	}
@@ -108,7 +113,7 @@ func TestCreateMachine(t *testing.T) {
 	}
 	// error on get config
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 			Host:   &host.Host{
 				Driver: &fakedriver.Driver{},
@@ -120,19 +125,28 @@ func TestCreateMachine(t *testing.T) {
 		t.Fatal(err)
 	}
 	// sucess test
+	server := newComputeAPI()
+	defer server.Close()
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &myAPI{},
 			Host:   &host.Host{
 				Driver: &successDriver{},
 			},
 			Name:   "testconfig",
 		},
+		project: "project",
+		zone:    "zone",
+		apiURL:  server.URL,
+		client:  server.Client(),
 	}
-	_, err = p.CreateMachine()
+	machine, err := p.CreateMachine()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if machine.ID != "3" {
+		t.Errorf("expected the ID of the instance but found %q", machine.ID)
+	}
 }
 
 type deleteAPI struct {
@@ -154,7 +168,7 @@ func (r removeDriver) Remove() error {
 func TestDeleteMachine(t *testing.T) {
 	// success
 	p := Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -167,7 +181,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on close will be ignored
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &deleteAPI{},
 		},
 	}
@@ -179,7 +193,7 @@ func TestDeleteMachine(t *testing.T) {
 	}
 	// error on remove
 	p = Provider{
-		iaas.Provider{
+		Provider: iaas.Provider{
 			Client: &libmachinetest.FakeAPI{},
 		},
 	}
@@ -191,3 +205,68 @@ func TestDeleteMachine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+
+// newComputeAPI serves the instances of project in zone, they are listed
+// in two pages
+func newComputeAPI() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/projects/project/zones/zone/instances/gofn-1":
+			fmt.Fprint(w, `{"name": "operation-1"}`)
+		case r.URL.Path == "/projects/project/zones/zone/instances/testconfig":
+			fmt.Fprint(w, `{"id": "3", "name": "testconfig"}`)
+		case r.URL.Path != "/projects/project/zones/zone/instances":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Query().Get("pageToken") == "":
+			fmt.Fprint(w, `{"items": [
+				{"id": "1", "name": "gofn-1", "creationTimestamp": "2020-01-02T03:04:05.000Z", "tags": {"items": ["gofn"]},
+				 "networkInterfaces": [{"accessConfigs": [{"natIP": "111.222.333.444"}]}]},
+				{"id": "2", "name": "other", "tags": {"items": ["gofn"]}}],
+				"nextPageToken": "next"}`)
+		default:
+			fmt.Fprint(w, `{"items": [{"id": "4", "name": "gofn-untagged"}]}`)
+		}
+	}))
+}
+
+func TestListMachines(t *testing.T) {
+	server := newComputeAPI()
+	defer server.Close()
+	p := Provider{project: "project", zone: "zone", apiURL: server.URL, client: server.Client()}
+	machines, err := p.ListMachines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []iaas.Machine{{
+		ID:        "1",
+		IP:        "111.222.333.444",
+		Kind:      "google",
+		Name:      "gofn-1",
+		SSHKeysID: []int{},
+		Created:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}}
+	if !reflect.DeepEqual(machines, want) {
+		t.Errorf("ListMachines() = %+v, want %+v", machines, want)
+	}
+	var _ iaas.ContextIaas = &p
+
+	p.zone = "unknown"
+	if _, err = p.ListMachines(context.Background()); err == nil {
+		t.Error("expecting errors for an unknown zone, but nothing found")
+	}
+}
+
+func TestRemoveMachine(t *testing.T) {
+	server := newComputeAPI()
+	defer server.Close()
+	p := Provider{project: "project", zone: "zone", apiURL: server.URL, client: server.Client()}
+	err := p.RemoveMachine(context.Background(), iaas.Machine{ID: "1", Name: "gofn-1"})
+	if err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	err = p.RemoveMachine(context.Background(), iaas.Machine{ID: "5", Name: "gofn-5"})
+	if err == nil {
+		t.Error("expecting errors for an unknown instance, but nothing found")
+	}
+}
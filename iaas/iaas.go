@@ -1,6 +1,8 @@
 package iaas
 
 import (
+	"time"
+
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/host"
 )
@@ -21,6 +23,8 @@ type Machine struct {
 	Kind      string `json:"kind"`
 	SSHKeysID []int  `json:"ssh_keys_id"`
 	CertsDir  string `json:"certs_dir"`
+	// Created is set by ListMachines when the provider knows it
+	Created time.Time `json:"created,omitempty"`
 }
 
 // Provider for gofn
@@ -0,0 +1,92 @@
+package iaas
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// pollInterval is how often the state of a machine is read while waiting
+// for it
+var pollInterval = 2 * time.Second
+
+// status converts the state of a docker machine driver
+func status(s state.State) Status {
+	switch s {
+	case state.Running:
+		return StatusRunning
+	case state.Starting:
+		return StatusStarting
+	case state.Stopping:
+		return StatusStopping
+	case state.Stopped, state.Paused, state.Saved:
+		return StatusStopped
+	case state.Error, state.Timeout:
+		return StatusError
+	}
+	return StatusUnknown
+}
+
+// MachineStatus returns the state of the machine read by its driver
+func (p *Provider) MachineStatus(ctx context.Context) (Status, error) {
+	if err := ctx.Err(); err != nil {
+		return StatusUnknown, err
+	}
+	s, err := p.Host.Driver.GetState()
+	if err != nil {
+		return StatusUnknown, err
+	}
+	return status(s), nil
+}
+
+// StopMachine stops the machine and waits it to be stopped
+func (p *Provider) StopMachine(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := p.Host.Driver.Stop()
+	if err != nil {
+		return err
+	}
+	return p.wait(ctx, StatusStopped)
+}
+
+// StartMachine starts the machine and waits it to be running
+func (p *Provider) StartMachine(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := p.Host.Driver.Start()
+	if err != nil {
+		return err
+	}
+	return p.WaitReady(ctx)
+}
+
+// WaitReady returns once the machine is running, or with an error when it
+// fails or ctx is done
+func (p *Provider) WaitReady(ctx context.Context) error {
+	return p.wait(ctx, StatusRunning)
+}
+
+func (p *Provider) wait(ctx context.Context, want Status) error {
+	for {
+		s, err := p.MachineStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if s == want {
+			return nil
+		}
+		if s == StatusError {
+			return fmt.Errorf("iaas: machine %v failed", p.Name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package iaas
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/drivers/fakedriver"
+	"github.com/docker/machine/libmachine/host"
+	"github.com/docker/machine/libmachine/libmachinetest"
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestProviderLifecycle(t *testing.T) {
+	driver := &fakedriver.Driver{MockState: state.Running}
+	p := &Provider{
+		Client: &libmachinetest.FakeAPI{},
+		Host:   &host.Host{Driver: driver},
+	}
+	ctx := context.Background()
+	s, err := p.MachineStatus(ctx)
+	if err != nil || s != StatusRunning {
+		t.Errorf("Expected %q but found %q, %v", StatusRunning, s, err)
+	}
+	if err = p.StopMachine(ctx); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if s, _ = p.MachineStatus(ctx); s != StatusStopped {
+		t.Errorf("Expected %q but found %q", StatusStopped, s)
+	}
+	if err = p.StartMachine(ctx); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if s, _ = p.MachineStatus(ctx); s != StatusRunning {
+		t.Errorf("Expected %q but found %q", StatusRunning, s)
+	}
+
+	driver.MockState = state.Error
+	if err = p.WaitReady(ctx); err == nil {
+		t.Error("expecting errors for a failed machine, but nothing found")
+	}
+	driver.MockState = state.Starting
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err = p.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %q but found %q", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+)
+
+// Provider definition, represents a host that exposes docker only through
+// SSH
+type Provider struct {
+	URL     string
+	Host    string
+	Port    int
+	User    string
+	Options provision.SSHOptions
+
+	mu     sync.Mutex
+	dialer *provision.SSHDialer
+}
+
+var (
+	errInvalidURL = errors.New("invalid SSH URL")
+)
+
+// New create provider, URL is in the ssh://[user@]host[:port] format
+func New(URL string, opts provision.SSHOptions) (p *Provider, err error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		err = errInvalidURL
+		return
+	}
+	clientPort := 22
+	if u.Port() != "" {
+		clientPort, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return
+		}
+	}
+	p = &Provider{
+		URL:     URL,
+		Host:    u.Hostname(),
+		Port:    clientPort,
+		User:    u.User.Username(),
+		Options: opts,
+	}
+	return
+}
+
+// CreateMachine ssh iaas
+func (p *Provider) CreateMachine() (*iaas.Machine, error) {
+	return &iaas.Machine{
+		IP:   p.Host,
+		Port: p.Port,
+		Kind: "SSH",
+	}, nil
+}
+
+// DeleteMachine ssh iaas, the host is kept and the SSH connection of the
+// docker clients is closed
+func (p *Provider) DeleteMachine() error {
+	p.mu.Lock()
+	dialer := p.dialer
+	p.dialer = nil
+	p.mu.Unlock()
+	if dialer == nil {
+		return nil
+	}
+	return dialer.Close()
+}
+
+// DockerClient returns a client that tunnels the docker API through SSH,
+// the clients share one SSH connection until DeleteMachine
+func (p *Provider) DockerClient() (*docker.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dialer == nil {
+		dialer, err := provision.NewSSHDialer(p.URL, p.Options)
+		if err != nil {
+			return nil, err
+		}
+		p.dialer = dialer
+	}
+	return p.dialer.DockerClient()
+}
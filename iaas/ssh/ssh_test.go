@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestNew(t *testing.T) {
+	type args struct {
+		URL string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantP   *Provider
+		wantErr bool
+	}{
+		{
+			"success",
+			args{
+				"ssh://gofn@localhost:2222",
+			},
+			&Provider{
+				URL:  "ssh://gofn@localhost:2222",
+				Host: "localhost",
+				Port: 2222,
+				User: "gofn",
+			},
+			false,
+		},
+		{
+			"default port",
+			args{
+				"ssh://localhost",
+			},
+			&Provider{
+				URL:  "ssh://localhost",
+				Host: "localhost",
+				Port: 22,
+			},
+			false,
+		},
+		{
+			"parse error",
+			args{
+				"ssh://localhost:port",
+			},
+			nil,
+			true,
+		},
+		{
+			"not ssh error",
+			args{
+				"tcp://localhost:2376",
+			},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotP, err := New(tt.args.URL, provision.SSHOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(gotP, tt.wantP) {
+				t.Errorf("New() = %v, want %v", gotP, tt.wantP)
+			}
+		})
+	}
+}
+
+func TestProvider_CreateMachine(t *testing.T) {
+	p, err := New("ssh://gofn@localhost", provision.SSHOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.CreateMachine()
+	if err != nil {
+		t.Errorf("Provider.CreateMachine() error = %v", err)
+		return
+	}
+	want := &iaas.Machine{IP: "localhost", Port: 22, Kind: "SSH"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Provider.CreateMachine() = %v, want %v", got, want)
+	}
+	if err = p.DeleteMachine(); err != nil {
+		t.Errorf("Provider.DeleteMachine() error = %v", err)
+	}
+}
+
+func TestProvider_DockerClient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := cryptossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := provision.SSHOptions{
+		Signers:         []cryptossh.Signer{signer},
+		HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
+	}
+	p, err := New("ssh://gofn@localhost", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := p.DockerClient()
+	if err == provision.ErrNotSupported {
+		t.Skip("SSH clients are not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Provider.DockerClient() error = %v", err)
+	}
+	other, err := p.DockerClient()
+	if err != nil {
+		t.Fatalf("Provider.DockerClient() error = %v", err)
+	}
+	if client.Dialer != other.Dialer {
+		t.Error("expected the clients to share the SSH dialer")
+	}
+	if err = p.DeleteMachine(); err != nil {
+		t.Errorf("Provider.DeleteMachine() error = %v", err)
+	}
+	if p.dialer != nil {
+		t.Error("expected the SSH dialer to be closed by DeleteMachine")
+	}
+}
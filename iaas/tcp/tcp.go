@@ -1,31 +1,128 @@
 package tcp
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gofn/gofn/iaas"
 )
 
+const (
+	defaultPort        = 2376
+	defaultPingTimeout = 10 * time.Second
+	readyPollInterval  = time.Second
+)
+
 // Provider definition, represents a concrete implementation of an iaas
 type Provider struct {
 	Host string
 	Port int
+	// TLS is enabled by the tcps and https schemes or by any certificate
+	// option. The server is verified with CAPEM, or with the CAs of the
+	// system when it is empty
+	TLS        bool
+	CertsDir   string
+	CertPEM    []byte
+	KeyPEM     []byte
+	CAPEM      []byte
+	ServerName string
+	// PingTimeout limits the connectivity check of CreateMachine
+	PingTimeout time.Duration
+
+	mu     sync.Mutex
+	client *docker.Client
 }
 
+// Option configures the provider
+type Option func(*Provider) error
+
 var (
 	errInvalidURL = errors.New("invalid TCP URL")
 )
 
-// New create provider
-func New(URL string) (p *Provider, err error) {
+// WithCertsDir reads cert.pem, key.pem and ca.pem from dir, like docker
+// does with DOCKER_CERT_PATH, missing files are not used
+func WithCertsDir(dir string) Option {
+	return func(p *Provider) (err error) {
+		p.CertsDir = dir
+		return withCertFiles(p, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"), true)
+	}
+}
+
+// WithCertFiles reads the client certificate, its key and the CA from
+// files, empty paths are not used
+func WithCertFiles(cert, key, ca string) Option {
+	return func(p *Provider) error {
+		return withCertFiles(p, cert, key, ca, false)
+	}
+}
+
+// WithPEM sets the client certificate, its key and the CA in the PEM format
+func WithPEM(cert, key, ca []byte) Option {
+	return func(p *Provider) error {
+		p.TLS = true
+		p.CertPEM, p.KeyPEM, p.CAPEM = cert, key, ca
+		return nil
+	}
+}
+
+// WithServerName verifies the certificate of the server against name
+// instead of the host of the URL
+func WithServerName(name string) Option {
+	return func(p *Provider) error {
+		p.TLS = true
+		p.ServerName = name
+		return nil
+	}
+}
+
+func withCertFiles(p *Provider, cert, key, ca string, optional bool) (err error) {
+	p.TLS = true
+	read := func(path string) ([]byte, error) {
+		if path == "" {
+			return nil, nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return b, err
+	}
+	p.CertPEM, err = read(cert)
+	if err != nil {
+		return
+	}
+	p.KeyPEM, err = read(key)
+	if err != nil {
+		return
+	}
+	p.CAPEM, err = read(ca)
+	return
+}
+
+// New create provider, URL schemes are tcp, tcps and https, the last two
+// enable TLS
+func New(URL string, opts ...Option) (p *Provider, err error) {
 	u, err := url.Parse(URL)
 	if err != nil {
 		return
 	}
-	if !strings.Contains(u.Scheme, "tcp") {
+	var useTLS bool
+	switch u.Scheme {
+	case "tcp":
+	case "tcps", "https":
+		useTLS = true
+	default:
 		err = errInvalidURL
 		return
 	}
@@ -36,23 +133,148 @@ func New(URL string) (p *Provider, err error) {
 			return
 		}
 	}
-	p = &Provider{
+	provider := &Provider{
 		Host: u.Hostname(),
 		Port: clientPort,
+		TLS:  useTLS,
+	}
+	for _, opt := range opts {
+		err = opt(provider)
+		if err != nil {
+			return
+		}
 	}
+	p = provider
 	return
 }
 
-// CreateMachine tcp iaas
+// CreateMachine tcp iaas, it fails when the docker daemon does not answer
 func (p *Provider) CreateMachine() (*iaas.Machine, error) {
-	return &iaas.Machine{
-		IP:   p.Host,
-		Port: p.Port,
-		Kind: "TCP",
-	}, nil
+	return p.CreateMachineContext(context.Background())
+}
+
+// CreateMachineContext is CreateMachine within ctx
+func (p *Provider) CreateMachineContext(ctx context.Context) (*iaas.Machine, error) {
+	err := p.ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.machine(), nil
 }
 
 // DeleteMachine tcp iaas
 func (p *Provider) DeleteMachine() error {
 	return nil
 }
+
+// DeleteMachineContext tcp iaas
+func (p *Provider) DeleteMachineContext(ctx context.Context) error {
+	return nil
+}
+
+// MachineStatus is running when the docker daemon answers
+func (p *Provider) MachineStatus(ctx context.Context) (iaas.Status, error) {
+	err := p.ping(ctx)
+	if err != nil {
+		return iaas.StatusUnknown, err
+	}
+	return iaas.StatusRunning, nil
+}
+
+// ListMachines returns the machine of the docker daemon
+func (p *Provider) ListMachines(ctx context.Context) ([]iaas.Machine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []iaas.Machine{*p.machine()}, nil
+}
+
+// StopMachine is not supported, the daemon is not managed by gofn
+func (p *Provider) StopMachine(ctx context.Context) error {
+	return iaas.ErrNotSupported
+}
+
+// StartMachine is not supported, the daemon is not managed by gofn
+func (p *Provider) StartMachine(ctx context.Context) error {
+	return iaas.ErrNotSupported
+}
+
+// WaitReady returns once the docker daemon answers or ctx is done
+func (p *Provider) WaitReady(ctx context.Context) error {
+	for {
+		err := p.ping(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+func (p *Provider) machine() *iaas.Machine {
+	return &iaas.Machine{
+		IP:       p.Host,
+		Port:     p.Port,
+		Kind:     "TCP",
+		CertsDir: p.CertsDir,
+	}
+}
+
+// ping checks the docker daemon within PingTimeout
+func (p *Provider) ping(ctx context.Context) error {
+	client, err := p.DockerClient()
+	if err != nil {
+		return err
+	}
+	timeout := p.PingTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = client.PingWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("tcp: docker at %v is not reachable: %v", p.addr(), err)
+	}
+	return nil
+}
+
+// DockerClient returns the client connected to the daemon, with TLS when
+// it is enabled
+func (p *Provider) DockerClient() (*docker.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client, nil
+	}
+	endpoint := "tcp://" + p.addr()
+	if !p.TLS {
+		client, err := docker.NewClient(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		p.client = client
+		return client, nil
+	}
+	client, err := docker.NewTLSClientFromBytes(endpoint, p.CertPEM, p.KeyPEM, p.CAPEM)
+	if err != nil {
+		return nil, err
+	}
+	// the client skips the verification when there is no CA, the CAs of
+	// the system are used instead
+	client.TLSConfig.InsecureSkipVerify = false
+	client.TLSConfig.ServerName = p.ServerName
+	p.client = client
+	return client, nil
+}
+
+func (p *Provider) addr() string {
+	port := p.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(p.Host, strconv.Itoa(port))
+}
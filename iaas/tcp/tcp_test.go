@@ -1,9 +1,25 @@
 package tcp
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
+	fake "github.com/fsouza/go-dockerclient/testing"
 	"github.com/gofn/gofn/iaas"
 )
 
@@ -28,6 +44,29 @@ func TestNew(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"tls",
+			args{
+				"tcps://localhost:2376",
+			},
+			&Provider{
+				Host: "localhost",
+				Port: 2376,
+				TLS:  true,
+			},
+			false,
+		},
+		{
+			"https",
+			args{
+				"https://localhost",
+			},
+			&Provider{
+				Host: "localhost",
+				TLS:  true,
+			},
+			false,
+		},
 		{
 			"parse error",
 			args{
@@ -60,6 +99,13 @@ func TestNew(t *testing.T) {
 }
 
 func TestProvider_CreateMachine(t *testing.T) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	host, port := serverAddr(t, server.URL())
+
 	type fields struct {
 		Host string
 		Port int
@@ -73,16 +119,25 @@ func TestProvider_CreateMachine(t *testing.T) {
 		{
 			"create machine",
 			fields{
-				"localhost",
-				2376,
+				host,
+				port,
 			},
 			&iaas.Machine{
-				IP:   "localhost",
-				Port: 2376,
+				IP:   host,
+				Port: port,
 				Kind: "TCP",
 			},
 			false,
 		},
+		{
+			"unreachable",
+			fields{
+				"127.0.0.1",
+				1,
+			},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -102,6 +157,119 @@ func TestProvider_CreateMachine(t *testing.T) {
 	}
 }
 
+func TestProvider_CreateMachineTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := writeCerts(t, dir, "docker.example")
+	server, err := fake.NewTLSServer("127.0.0.1:0", nil, nil, fake.TLSConfig{
+		CertPath:    filepath.Join(dir, "server.pem"),
+		CertKeyPath: filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	host, port := serverAddr(t, server.URL())
+	URL := fmt.Sprintf("tcps://%v:%v", host, port)
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{"server name", []Option{WithPEM(nil, nil, ca), WithServerName("docker.example")}, false},
+		{"ca file", []Option{WithCertFiles("", "", filepath.Join(dir, "ca.pem")), WithServerName("docker.example")}, false},
+		{"host name mismatch", []Option{WithPEM(nil, nil, ca)}, true},
+		{"unknown authority", []Option{WithServerName("docker.example")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(URL, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.CreateMachine()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Provider.CreateMachine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func serverAddr(t *testing.T, serverURL string) (string, int) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Hostname(), port
+}
+
+// writeCerts writes a CA and a certificate for name signed by it, the PEM
+// of the CA is returned
+func writeCerts(t *testing.T, dir, name string) []byte {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gofn CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	files := map[string][]byte{
+		"ca.pem":         ca,
+		"server.pem":     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"server-key.pem": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for file, b := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, file), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ca
+}
+
 func TestProvider_DeleteMachine(t *testing.T) {
 	type fields struct {
 		Host string
@@ -133,3 +301,40 @@ func TestProvider_DeleteMachine(t *testing.T) {
 		})
 	}
 }
+
+func TestProvider_MachineStatus(t *testing.T) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	host, port := serverAddr(t, server.URL())
+	p := &Provider{Host: host, Port: port}
+	var _ iaas.ContextIaas = p
+
+	ctx := context.Background()
+	status, err := p.MachineStatus(ctx)
+	if err != nil || status != iaas.StatusRunning {
+		t.Errorf("Provider.MachineStatus() = %v, %v, want %v", status, err, iaas.StatusRunning)
+	}
+	if err = p.WaitReady(ctx); err != nil {
+		t.Errorf("Provider.WaitReady() error = %v", err)
+	}
+	machines, err := p.ListMachines(ctx)
+	if err != nil || len(machines) != 1 || machines[0].IP != host {
+		t.Errorf("Provider.ListMachines() = %v, %v, want the machine of %v", machines, err, host)
+	}
+	if err = p.StopMachine(ctx); err != iaas.ErrNotSupported {
+		t.Errorf("Provider.StopMachine() error = %v, want %v", err, iaas.ErrNotSupported)
+	}
+
+	unreachable := &Provider{Host: "127.0.0.1", Port: 1}
+	if _, err = unreachable.MachineStatus(ctx); err == nil {
+		t.Error("Provider.MachineStatus() expected an error for an unreachable daemon")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err = unreachable.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Provider.WaitReady() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
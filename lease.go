@@ -0,0 +1,204 @@
+package gofn
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/nuveo/log"
+)
+
+const defaultLeaseTTL = time.Minute
+
+// LeaseState is the state of the lease of a machine or an owner
+type LeaseState int
+
+const (
+	// LeaseNone is the state of what was never leased or whose lease was
+	// released
+	LeaseNone LeaseState = iota
+	// LeaseAlive is the state of a lease renewed within its TTL
+	LeaseAlive
+	// LeaseExpired is the state of a lease not renewed within its TTL, its
+	// owner is gone
+	LeaseExpired
+)
+
+// Leases tell whether the owner of a machine or a container is alive, the
+// owners renew the lease of what they use while they use it with KeepLease
+type Leases interface {
+	// State returns the state of the lease of id
+	State(ctx context.Context, id string) (LeaseState, error)
+}
+
+// LeaseHolder takes and gives up leases, like FileLeases
+type LeaseHolder interface {
+	// Renew takes or extends the lease of id
+	Renew(id string) error
+	// Release gives the lease of id up
+	Release(id string) error
+}
+
+// FileLeases keeps each lease in a file of Dir named by the leased id, so
+// the processes of a host share them. A lease is alive while its file was
+// modified within TTL, zero keeps it for a minute
+type FileLeases struct {
+	Dir string
+	TTL time.Duration
+}
+
+// Renew takes or extends the lease of id
+func (l *FileLeases) Renew(id string) error {
+	path, err := l.path(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return err
+}
+
+// Release gives the lease of id up
+func (l *FileLeases) Release(id string) error {
+	path, err := l.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// State returns whether the lease of id was renewed within l.TTL, it is
+// LeaseNone when there is no file
+func (l *FileLeases) State(ctx context.Context, id string) (LeaseState, error) {
+	path, err := l.path(id)
+	if err != nil {
+		return LeaseNone, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return LeaseNone, nil
+	}
+	if err != nil {
+		return LeaseNone, err
+	}
+	if time.Since(info.ModTime()) < l.ttl() {
+		return LeaseAlive, nil
+	}
+	return LeaseExpired, nil
+}
+
+func (l *FileLeases) ttl() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return defaultLeaseTTL
+}
+
+func (l *FileLeases) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return "", errors.New("gofn: invalid lease id " + id)
+	}
+	return filepath.Join(l.Dir, id), nil
+}
+
+// KeepLease takes the lease of id and renews it in background, three times
+// within the TTL of FileLeases or every 20 seconds for other holders.
+// release stops renewing and gives the lease up
+func KeepLease(holder LeaseHolder, id string) (release func()) {
+	err := holder.Renew(id)
+	if err != nil {
+		log.Errorf("error trying to renew the lease of %v: %v\n", id, err)
+	}
+	interval := defaultLeaseTTL / 3
+	if l, ok := holder.(*FileLeases); ok {
+		interval = l.ttl() / 3
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewErr := holder.Renew(id)
+				if renewErr != nil {
+					log.Errorf("error trying to renew the lease of %v: %v\n", id, renewErr)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			releaseErr := holder.Release(id)
+			if releaseErr != nil {
+				log.Errorf("error trying to release the lease of %v: %v\n", id, releaseErr)
+			}
+		})
+	}
+}
+
+// held counts the users of each machine in this process by name, a Reaper
+// of the process does not reap them
+var held = struct {
+	sync.Mutex
+	names map[string]int
+}{names: make(map[string]int)}
+
+// holdMachine marks the machine as used by this process and keeps its lease
+// in leases when it is not nil, until release is called
+func holdMachine(leases LeaseHolder, machine *iaas.Machine) (release func()) {
+	name := machine.Name
+	if name == "" {
+		return func() {}
+	}
+	held.Lock()
+	held.names[name]++
+	held.Unlock()
+	releaseLease := func() {}
+	if leases != nil {
+		releaseLease = KeepLease(leases, name)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			releaseLease()
+			held.Lock()
+			held.names[name]--
+			if held.names[name] <= 0 {
+				delete(held.names, name)
+			}
+			held.Unlock()
+		})
+	}
+}
+
+// machineHeld reports whether the machine is used by this process
+func machineHeld(name string) bool {
+	held.Lock()
+	defer held.Unlock()
+	return held.names[name] > 0
+}
@@ -0,0 +1,565 @@
+package gofn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+	"github.com/nuveo/log"
+)
+
+// ErrManagerClosed is returned by MachineManager.Run after the manager is closed
+var ErrManagerClosed = errors.New("gofn: machine manager closed")
+
+const (
+	defaultIdleTTL    = 10 * time.Minute
+	attachPingTimeout = 10 * time.Second
+)
+
+// MachineFactory creates the Iaas of the machines of a MachineManager, each
+// iaas.Iaas provides a single machine
+type MachineFactory interface {
+	// New returns the Iaas of a new machine
+	New() (iaas.Iaas, error)
+	// Attach returns the Iaas of a machine created by another manager, read
+	// from its state file. CreateMachine is not called on it
+	Attach(machine iaas.Machine) (iaas.Iaas, error)
+}
+
+// MachineManagerOptions configures a MachineManager
+type MachineManagerOptions struct {
+	// IdleTTL is how long a machine without invocations is kept before it
+	// is deleted, zero keeps it for 10 minutes
+	IdleTTL time.Duration
+	// MaxMachines caps the number of machines, invocations wait for a free
+	// machine when every machine is busy. Zero does not cap them
+	MaxMachines int
+	// Concurrency is the number of invocations run at the same time in a
+	// machine, zero runs one at a time
+	Concurrency int
+	// StateFile keeps the machines in the JSON format. A manager created
+	// with the same file reattaches to the machines still alive and deletes
+	// the other ones, nothing is kept when it is empty
+	StateFile string
+	// KeepOnClose leaves the machines running after Close, so the next
+	// manager reattaches to them through StateFile
+	KeepOnClose bool
+	// Leases keeps the lease of each machine, by name, while the manager
+	// has it, so a Reaper of another process does not reap it
+	Leases LeaseHolder
+}
+
+// ManagedMachine describes a machine of a MachineManager
+type ManagedMachine struct {
+	Machine iaas.Machine
+	// Running is the number of invocations running in the machine
+	Running  int
+	LastUsed time.Time
+}
+
+type managedMachine struct {
+	service  iaas.Iaas
+	machine  *iaas.Machine
+	rt       provision.Runtime
+	running  int
+	lastUsed time.Time
+	// draining machines take no invocations while they are checked before
+	// being deleted
+	draining bool
+	// release gives the machine up, see holdMachine
+	release func()
+}
+
+// machineState is a machine in the state file
+type machineState struct {
+	Machine  iaas.Machine `json:"machine"`
+	LastUsed time.Time    `json:"last_used"`
+}
+
+// MachineManager keeps the machines provided by an Iaas between invocations,
+// so they are not created and deleted by each one like Run does. Machines
+// idle for longer than IdleTTL are deleted
+type MachineManager struct {
+	factory MachineFactory
+	opts    MachineManagerOptions
+
+	// autoscaled managers do not create machines for the invocations, which
+	// wait for the machines created by an Autoscaler
+	autoscaled bool
+
+	mu       sync.Mutex
+	machines []*managedMachine
+	creating int
+	// waiting is the number of invocations waiting for a machine
+	waiting int
+	// wake is signaled when an invocation starts waiting
+	wake chan struct{}
+	// detached are the machines of the state file which could not be
+	// attached or deleted, they are kept in the file for the next manager
+	detached []machineState
+	// released is closed and replaced when a machine may take another
+	// invocation
+	released chan struct{}
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewMachineManager creates a manager of the machines of factory. The
+// machines in opts.StateFile are attached when they answer and were used
+// within opts.IdleTTL, and deleted otherwise
+func NewMachineManager(ctx context.Context, factory MachineFactory, opts MachineManagerOptions) (m *MachineManager, err error) {
+	return newMachineManager(ctx, factory, opts, false)
+}
+
+func newMachineManager(ctx context.Context, factory MachineFactory, opts MachineManagerOptions, autoscaled bool) (m *MachineManager, err error) {
+	if opts.IdleTTL <= 0 {
+		opts.IdleTTL = defaultIdleTTL
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	m = &MachineManager{
+		factory:    factory,
+		opts:       opts,
+		autoscaled: autoscaled,
+		released:   make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	err = m.load(ctx)
+	if err != nil {
+		m = nil
+		return
+	}
+	m.mu.Lock()
+	err = m.save()
+	m.mu.Unlock()
+	if err != nil {
+		m = nil
+		return
+	}
+	if !autoscaled {
+		m.wg.Add(1)
+		go m.idleLoop()
+	}
+	return
+}
+
+// Run runs the function in a machine of the manager, a machine is created
+// when none is free and the cap allows it. buildOpts.Iaas is ignored and
+// the machine which ran the function is in Result.Machine
+func (m *MachineManager) Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (result *Result, err error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	result, err = m.RunStream(ctx, buildOpts, containerOpts, stdout, stderr)
+	if result != nil {
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+	}
+	return
+}
+
+// RunStream runs the function like Run, but writes its output to stdout and
+// stderr while it is produced
+func (m *MachineManager) RunStream(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	mm, err := m.acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer m.release(mm)
+	result, err = RunStreamWithRuntime(ctx, mm.rt, buildOpts, containerOpts, stdout, stderr)
+	if result != nil {
+		result.Machine = mm.machine
+	}
+	return
+}
+
+// Machines returns the machines of the manager
+func (m *MachineManager) Machines() []ManagedMachine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	machines := make([]ManagedMachine, 0, len(m.machines))
+	for _, mm := range m.machines {
+		machines = append(machines, ManagedMachine{
+			Machine:  *mm.machine,
+			Running:  mm.running,
+			LastUsed: mm.lastUsed,
+		})
+	}
+	return machines
+}
+
+// Close stops deleting the idle machines and deletes every machine unless
+// opts.KeepOnClose is set, machines still running invocations are deleted
+// when they finish
+func (m *MachineManager) Close() (err error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	var idle, kept []*managedMachine
+	if !m.opts.KeepOnClose {
+		for _, mm := range m.machines {
+			if mm.running == 0 {
+				idle = append(idle, mm)
+			}
+		}
+		m.remove(idle)
+	} else {
+		kept = append(kept, m.machines...)
+	}
+	err = m.save()
+	// waiting invocations return ErrManagerClosed
+	m.signal()
+	m.mu.Unlock()
+
+	close(m.done)
+	m.wg.Wait()
+	// the machines kept for the next manager are not used anymore
+	for _, mm := range kept {
+		mm.release()
+	}
+	for _, mm := range idle {
+		deleteErr := m.discard(mm)
+		if deleteErr != nil {
+			err = deleteErr
+		}
+	}
+	return
+}
+
+func (m *MachineManager) acquire(ctx context.Context) (*managedMachine, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, ErrManagerClosed
+		}
+		if mm := m.free(); mm != nil {
+			mm.running++
+			m.mu.Unlock()
+			return mm, nil
+		}
+		if !m.autoscaled && (m.opts.MaxMachines <= 0 || len(m.machines)+m.creating < m.opts.MaxMachines) {
+			m.creating++
+			m.mu.Unlock()
+			return m.create(ctx, 1)
+		}
+		released := m.released
+		m.waiting++
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+		m.mu.Unlock()
+
+		var err error
+		select {
+		case <-released:
+		case <-ctx.Done():
+			err = contextError(ctx, ctx.Err())
+		}
+		m.mu.Lock()
+		m.waiting--
+		m.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// free returns the busiest machine which can take another invocation, so
+// the invocations are packed and the other machines become idle. It must
+// be called with m.mu held
+func (m *MachineManager) free() (free *managedMachine) {
+	for _, mm := range m.machines {
+		if mm.running >= m.opts.Concurrency || mm.draining {
+			continue
+		}
+		if free == nil || mm.running > free.running ||
+			mm.running == free.running && mm.lastUsed.After(free.lastUsed) {
+			free = mm
+		}
+	}
+	return
+}
+
+// create provides a new machine running the given number of invocations,
+// m.creating must be incremented by the caller
+func (m *MachineManager) create(ctx context.Context, running int) (*managedMachine, error) {
+	service, err := m.factory.New()
+	var mm *managedMachine
+	if err == nil {
+		client, machine, provideErr := ProvideMachine(ctx, service)
+		err = provideErr
+		if err == nil {
+			mm = &managedMachine{
+				service:  service,
+				machine:  machine,
+				rt:       provision.NewDockerRuntime(client),
+				running:  running,
+				lastUsed: time.Now(),
+				release:  holdMachine(m.opts.Leases, machine),
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.creating--
+	// another invocation may create the machine or use the new one
+	m.signal()
+	if err != nil {
+		m.mu.Unlock()
+		return nil, contextError(ctx, err)
+	}
+	// a machine without invocations is not released, it is deleted now when
+	// the manager was closed
+	orphan := running == 0 && m.closed && !m.opts.KeepOnClose
+	if !orphan {
+		m.machines = append(m.machines, mm)
+	}
+	saveErr := m.save()
+	m.mu.Unlock()
+
+	if saveErr != nil {
+		log.Errorf("error trying to save the machines %v\n", saveErr)
+	}
+	if orphan {
+		return nil, m.discard(mm)
+	}
+	return mm, nil
+}
+
+func (m *MachineManager) release(mm *managedMachine) {
+	m.mu.Lock()
+	mm.running--
+	mm.lastUsed = time.Now()
+	remove := m.closed && !m.opts.KeepOnClose && mm.running == 0
+	if remove {
+		m.remove([]*managedMachine{mm})
+	}
+	saveErr := m.save()
+	m.signal()
+	m.mu.Unlock()
+
+	if saveErr != nil {
+		log.Errorf("error trying to save the machines %v\n", saveErr)
+	}
+	if remove {
+		err := m.discard(mm)
+		if err != nil {
+			log.Errorln(err)
+		}
+	}
+}
+
+// idleLoop deletes the machines idle for longer than opts.IdleTTL
+func (m *MachineManager) idleLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(tickInterval(m.opts.IdleTTL))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.reap(now)
+		}
+	}
+}
+
+func (m *MachineManager) reap(now time.Time) {
+	m.mu.Lock()
+	var idle []*managedMachine
+	for _, mm := range m.machines {
+		if mm.running == 0 && now.Sub(mm.lastUsed) >= m.opts.IdleTTL {
+			idle = append(idle, mm)
+		}
+	}
+	if len(idle) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.remove(idle)
+	saveErr := m.save()
+	// the cap allows other machines now
+	m.signal()
+	m.mu.Unlock()
+
+	if saveErr != nil {
+		log.Errorf("error trying to save the machines %v\n", saveErr)
+	}
+	for _, mm := range idle {
+		err := m.discard(mm)
+		if err != nil {
+			log.Errorln(err)
+		}
+	}
+}
+
+// remove takes the machines out of the manager, it must be called with m.mu
+// held
+func (m *MachineManager) remove(machines []*managedMachine) {
+	removed := make(map[*managedMachine]bool)
+	for _, mm := range machines {
+		removed[mm] = true
+	}
+	kept := m.machines[:0]
+	for _, mm := range m.machines {
+		if !removed[mm] {
+			kept = append(kept, mm)
+		}
+	}
+	for i := len(kept); i < len(m.machines); i++ {
+		m.machines[i] = nil
+	}
+	m.machines = kept
+}
+
+// has reports whether the machine was not removed, it must be called with
+// m.mu held
+func (m *MachineManager) has(mm *managedMachine) bool {
+	for _, v := range m.machines {
+		if v == mm {
+			return true
+		}
+	}
+	return false
+}
+
+// signal wakes the invocations waiting for a machine, it must be called
+// with m.mu held
+func (m *MachineManager) signal() {
+	close(m.released)
+	m.released = make(chan struct{})
+}
+
+// discard deletes a machine removed from the manager, it is kept in the
+// state file when the delete fails so the next manager deletes it
+func (m *MachineManager) discard(mm *managedMachine) error {
+	err := m.delete(mm)
+	if err == nil || m.opts.StateFile == "" {
+		return err
+	}
+	m.mu.Lock()
+	m.detached = append(m.detached, machineState{Machine: *mm.machine, LastUsed: mm.lastUsed})
+	saveErr := m.save()
+	m.mu.Unlock()
+	if saveErr != nil {
+		log.Errorf("error trying to save the machines %v\n", saveErr)
+	}
+	return err
+}
+
+func (m *MachineManager) delete(mm *managedMachine) error {
+	if mm.release != nil {
+		mm.release()
+	}
+	log.Debugf("trying to delete machine ID:%v\n", mm.machine.ID)
+	err := mm.service.DeleteMachine()
+	if err != nil {
+		log.Errorf("error trying to delete machine %v: %v\n", mm.machine.ID, err)
+	}
+	return err
+}
+
+// load attaches the machines of the state file
+func (m *MachineManager) load(ctx context.Context) error {
+	if m.opts.StateFile == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(m.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var states []machineState
+	err = json.Unmarshal(raw, &states)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, state := range states {
+		machine := state.Machine
+		service, err := m.factory.Attach(machine)
+		if err != nil {
+			log.Errorf("error trying to attach machine %v: %v\n", machine.ID, err)
+			m.detached = append(m.detached, state)
+			continue
+		}
+		if now.Sub(state.LastUsed) < m.opts.IdleTTL {
+			rt, err := m.connect(ctx, service, &machine)
+			if err == nil {
+				m.machines = append(m.machines, &managedMachine{
+					service:  service,
+					machine:  &machine,
+					rt:       rt,
+					lastUsed: state.LastUsed,
+					release:  holdMachine(m.opts.Leases, &machine),
+				})
+				continue
+			}
+			log.Errorf("machine %v does not answer, deleting it: %v\n", machine.ID, err)
+		}
+		err = m.delete(&managedMachine{service: service, machine: &machine})
+		if err != nil {
+			// the machine is deleted by the next manager
+			m.detached = append(m.detached, state)
+		}
+	}
+	return nil
+}
+
+// connect returns the runtime of an attached machine once its docker daemon
+// answers
+func (m *MachineManager) connect(ctx context.Context, service iaas.Iaas, machine *iaas.Machine) (provision.Runtime, error) {
+	client, err := machineClient(service, machine)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, attachPingTimeout)
+	defer cancel()
+	err = client.PingWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provision.NewDockerRuntime(client), nil
+}
+
+// save writes the machines to the state file, it must be called with m.mu
+// held
+func (m *MachineManager) save() error {
+	if m.opts.StateFile == "" {
+		return nil
+	}
+	states := append([]machineState(nil), m.detached...)
+	for _, mm := range m.machines {
+		states = append(states, machineState{Machine: *mm.machine, LastUsed: mm.lastUsed})
+	}
+	raw, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file is replaced at once, so a crash does not leave it truncated
+	tmp := m.opts.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.opts.StateFile)
+}
@@ -0,0 +1,340 @@
+package gofn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+)
+
+// fakeFactory provides machines whose docker daemon is a fake server
+type fakeFactory struct {
+	url string
+
+	mu       sync.Mutex
+	next     int
+	created  []string
+	attached []string
+	deleted  []string
+	// failNew and failDelete fail the new machines and the deletes
+	failNew    error
+	failDelete error
+	// creating blocks the creates until it is closed when it is not nil
+	creating chan struct{}
+}
+
+type fakeMachine struct {
+	factory *fakeFactory
+	id      string
+}
+
+func (f *fakeFactory) New() (iaas.Iaas, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	if f.failNew != nil {
+		return nil, f.failNew
+	}
+	return &fakeMachine{factory: f, id: fmt.Sprintf("machine-%d", f.next)}, nil
+}
+
+func (f *fakeFactory) Attach(machine iaas.Machine) (iaas.Iaas, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attached = append(f.attached, machine.ID)
+	return &fakeMachine{factory: f, id: machine.ID}, nil
+}
+
+func (f *fakeFactory) count() (created, attached, deleted int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.created), len(f.attached), len(f.deleted)
+}
+
+func (m *fakeMachine) CreateMachine() (*iaas.Machine, error) {
+	m.factory.mu.Lock()
+	creating := m.factory.creating
+	m.factory.mu.Unlock()
+	if creating != nil {
+		<-creating
+	}
+	m.factory.mu.Lock()
+	defer m.factory.mu.Unlock()
+	m.factory.created = append(m.factory.created, m.id)
+	return &iaas.Machine{ID: m.id, Kind: "fake"}, nil
+}
+
+func (m *fakeMachine) DeleteMachine() error {
+	m.factory.mu.Lock()
+	defer m.factory.mu.Unlock()
+	if m.factory.failDelete != nil {
+		return m.factory.failDelete
+	}
+	m.factory.deleted = append(m.factory.deleted, m.id)
+	return nil
+}
+
+func (m *fakeMachine) DockerClient() (*docker.Client, error) {
+	return docker.NewClient(m.factory.url)
+}
+
+func newFakeFactory(t *testing.T) (*fakeFactory, func()) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeFactory{url: server.URL()}, server.Stop
+}
+
+func TestMachineManagerReuse(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	m, err := NewMachineManager(context.Background(), factory, MachineManagerOptions{MaxMachines: 1})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	buildOpts := &provision.BuildOptions{
+		ContextDir: "./provision/testing_data",
+		ImageName:  "machinetest",
+	}
+	// the fake containers run until they are stopped
+	containerOpts := &provision.ContainerOptions{
+		Timeout:     50 * time.Millisecond,
+		StopTimeout: time.Second,
+	}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		result, err := m.Run(context.Background(), buildOpts, containerOpts)
+		if err != provision.ErrTimeout {
+			t.Fatalf("Expected %q but found %q", provision.ErrTimeout, err)
+		}
+		ids = append(ids, result.Machine.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("expected the machine to be reused but found %v", ids)
+	}
+	if created, _, _ := factory.count(); created != 1 {
+		t.Errorf("expected one machine to be created but found %d", created)
+	}
+
+	// the cap makes the next invocation wait for the busy machine
+	busy, err := m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = m.acquire(ctx); err != ErrDeadlineExceeded {
+		t.Errorf("Expected %q but found %q", ErrDeadlineExceeded, err)
+	}
+	acquired := make(chan *managedMachine)
+	go func() {
+		mm, _ := m.acquire(context.Background())
+		acquired <- mm
+	}()
+	m.release(busy)
+	if mm := <-acquired; mm != busy {
+		t.Errorf("expected the released machine but found %v", mm)
+	} else {
+		m.release(mm)
+	}
+
+	if err = m.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if _, _, deleted := factory.count(); deleted != 1 {
+		t.Errorf("expected the machine to be deleted on close but found %d deleted", deleted)
+	}
+	if _, err = m.Run(context.Background(), buildOpts, containerOpts); err != ErrManagerClosed {
+		t.Errorf("Expected %q but found %q", ErrManagerClosed, err)
+	}
+}
+
+func TestMachineManagerIdle(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	m, err := NewMachineManager(context.Background(), factory, MachineManagerOptions{IdleTTL: time.Hour, Concurrency: 2})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer m.Close()
+
+	first, err := m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	second, err := m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if first != second {
+		t.Error("expected both invocations in the same machine")
+	}
+	m.release(first)
+	m.reap(time.Now().Add(2 * time.Hour))
+	if machines := m.Machines(); len(machines) != 1 || machines[0].Running != 1 {
+		t.Errorf("expected the busy machine to be kept but found %+v", machines)
+	}
+	m.release(second)
+	m.reap(time.Now().Add(30 * time.Minute))
+	if len(m.Machines()) != 1 {
+		t.Error("expected the machine to be kept within the idle TTL")
+	}
+	m.reap(time.Now().Add(2 * time.Hour))
+	if machines := m.Machines(); len(machines) != 0 {
+		t.Errorf("expected the idle machine to be deleted but found %+v", machines)
+	}
+	if _, _, deleted := factory.count(); deleted != 1 {
+		t.Errorf("expected one machine deleted but found %d", deleted)
+	}
+}
+
+func TestMachineManagerStateFile(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := MachineManagerOptions{
+		StateFile:   filepath.Join(dir, "machines.json"),
+		KeepOnClose: true,
+	}
+
+	m, err := NewMachineManager(context.Background(), factory, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	mm, err := m.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	m.release(mm)
+	if err = m.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if _, _, deleted := factory.count(); deleted != 0 {
+		t.Errorf("expected the machine to be kept on close but found %d deleted", deleted)
+	}
+
+	// a machine idle for too long is deleted by the next manager
+	raw, err := ioutil.ReadFile(opts.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []machineState
+	if err = json.Unmarshal(raw, &states); err != nil {
+		t.Fatal(err)
+	}
+	states = append(states, machineState{
+		Machine:  iaas.Machine{ID: "expired", Kind: "fake"},
+		LastUsed: time.Now().Add(-time.Hour),
+	})
+	raw, err = json.Marshal(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(opts.StateFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = NewMachineManager(context.Background(), factory, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer m.Close()
+	machines := m.Machines()
+	if len(machines) != 1 || machines[0].Machine.ID != mm.machine.ID {
+		t.Errorf("expected machine %v to be reattached but found %+v", mm.machine.ID, machines)
+	}
+	created, attached, deleted := factory.count()
+	if created != 1 || attached != 2 || deleted != 1 {
+		t.Errorf("expected 1 machine created, 2 attached and 1 deleted but found %d, %d and %d", created, attached, deleted)
+	}
+	if again, err := m.acquire(context.Background()); err != nil || again.machine.ID != mm.machine.ID {
+		t.Errorf("expected the reattached machine to be used but found %v, %v", again, err)
+	} else {
+		m.release(again)
+	}
+}
+
+func TestMachineManagerStateFileFailedDelete(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := MachineManagerOptions{StateFile: filepath.Join(dir, "machines.json")}
+	states := []machineState{{
+		Machine:  iaas.Machine{ID: "expired", Kind: "fake"},
+		LastUsed: time.Now().Add(-time.Hour),
+	}}
+	raw, err := json.Marshal(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(opts.StateFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the machine whose delete fails is kept for the next manager
+	factory.failDelete = errors.New("delete failed")
+	m, err := NewMachineManager(context.Background(), factory, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = m.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	raw, err = ioutil.ReadFile(opts.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states = nil
+	if err = json.Unmarshal(raw, &states); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Machine.ID != "expired" {
+		t.Errorf("expected the machine to be kept in the state file but found %+v", states)
+	}
+
+	factory.failDelete = nil
+	m, err = NewMachineManager(context.Background(), factory, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer m.Close()
+	if _, _, deleted := factory.count(); deleted != 1 {
+		t.Errorf("expected the machine to be deleted by the next manager but found %d deleted", deleted)
+	}
+	if len(m.detached) != 0 {
+		t.Errorf("expected no detached machines but found %+v", m.detached)
+	}
+}
+
+func TestMachineManagerShortIdleTTL(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	m, err := NewMachineManager(context.Background(), factory, MachineManagerOptions{IdleTTL: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = m.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
@@ -0,0 +1,378 @@
+package gofn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+	"github.com/nuveo/log"
+)
+
+// ErrPoolClosed is returned by Pool.Run after the pool is closed
+var ErrPoolClosed = errors.New("gofn: pool closed")
+
+// minTickInterval bounds how often the background loops check their TTL
+const minTickInterval = 10 * time.Millisecond
+
+// tickInterval returns how often a TTL is checked, half of it and at least
+// minTickInterval
+func tickInterval(ttl time.Duration) time.Duration {
+	if d := ttl / 2; d > minTickInterval {
+		return d
+	}
+	return minTickInterval
+}
+
+// PoolOptions configures a Pool
+type PoolOptions struct {
+	// Size is the number of idle containers kept ready to run
+	Size int
+	// MaxUses is the number of invocations served by a container before it
+	// is replaced, each container serves a single invocation when it is
+	// zero. Containers are reused by starting them again, which the
+	// kubernetes runtime does not support
+	MaxUses int
+	// IdleTTL replaces containers idle for longer than it, zero keeps them
+	// until they reach MaxUses
+	IdleTTL time.Duration
+}
+
+// PoolStats are the metrics of a Pool
+type PoolStats struct {
+	Idle  int
+	InUse int
+	// Hits counts invocations served by an idle container and Misses the
+	// ones that waited for a container to be created
+	Hits      uint64
+	Misses    uint64
+	Created   uint64
+	Destroyed uint64
+}
+
+type pooledContainer struct {
+	id        string
+	uses      int
+	idleSince time.Time
+	// returning is set while an invocation uses a container which goes
+	// back to the pool after it
+	returning bool
+}
+
+// Pool keeps containers of a function created ahead of time, so invocations
+// do not wait for the container to be created nor destroyed
+type Pool struct {
+	rt            provision.Runtime
+	buildOpts     *provision.BuildOptions
+	containerOpts provision.ContainerOptions
+	opts          PoolOptions
+
+	mu       sync.Mutex
+	idle     []*pooledContainer
+	inUse    int
+	creating int
+	// returning counts the containers in use that go back to the pool, they
+	// are not replaced while they run
+	returning int
+	stats     PoolStats
+	closed    bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPool creates a pool of containers for the function, the image is built
+// when necessary and opts.Size containers are created before returning.
+// containerOpts.Stdin is ignored, the input is given to each invocation.
+// provision.ErrNotSupported is returned for containerOpts.IsolatedNetwork,
+// the pooled containers are created before their invocation has a network
+func NewPool(ctx context.Context, rt provision.Runtime, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, opts PoolOptions) (p *Pool, err error) {
+	if containerOpts == nil {
+		containerOpts = &provision.ContainerOptions{}
+	}
+	if containerOpts.IsolatedNetwork {
+		err = provision.ErrNotSupported
+		return
+	}
+	if opts.MaxUses <= 0 {
+		opts.MaxUses = 1
+	}
+	p = &Pool{
+		rt:            rt,
+		buildOpts:     buildOpts,
+		containerOpts: *containerOpts,
+		opts:          opts,
+		done:          make(chan struct{}),
+	}
+	p.containerOpts.Stdin = nil
+
+	err = p.fill(ctx)
+	if err != nil {
+		closeErr := p.Close()
+		if closeErr != nil {
+			log.Errorln(closeErr)
+		}
+		p = nil
+		err = contextError(ctx, err)
+		return
+	}
+	if opts.IdleTTL > 0 {
+		p.wg.Add(1)
+		go p.evictLoop()
+	}
+	return
+}
+
+// Run runs the function in a container of the pool writing stdin to it
+func (p *Pool) Run(ctx context.Context, stdin io.Reader) (result *Result, err error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	result, err = p.RunStream(ctx, stdin, stdout, stderr)
+	if result != nil {
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+	}
+	return
+}
+
+// RunStream runs the function in a container of the pool like Run, but
+// writes its output to stdout and stderr while it is produced
+func (p *Pool) RunStream(ctx context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return
+	}
+	runOpts := p.containerOpts
+	runOpts.Stdin = stdin
+	result = &Result{ContainerID: c.id}
+	err = provision.RunContainer(ctx, p.rt, c.id, runOpts, stdout, stderr)
+	err = contextError(ctx, err)
+	inspectResult(p.rt, result)
+	p.release(c, err)
+	return
+}
+
+// Stats returns the current metrics of the pool
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = p.inUse
+	return stats
+}
+
+// Close destroys the idle containers, containers in use are destroyed when
+// their invocation finishes
+func (p *Pool) Close() (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, c := range idle {
+		destroyErr := p.destroy(c)
+		if destroyErr != nil {
+			err = destroyErr
+		}
+	}
+	p.wg.Wait()
+	return
+}
+
+func (p *Pool) acquire(ctx context.Context) (c *pooledContainer, err error) {
+	now := time.Now()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		err = ErrPoolClosed
+		return
+	}
+	for c == nil && len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(c, now) {
+			p.replace(c)
+			c = nil
+		}
+	}
+	p.inUse++
+	if c != nil {
+		p.stats.Hits++
+		if c.uses+1 < p.opts.MaxUses {
+			c.returning = true
+			p.returning++
+		} else {
+			p.refill()
+		}
+		p.mu.Unlock()
+		return
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	c, err = p.create(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.inUse--
+		p.mu.Unlock()
+		err = contextError(ctx, err)
+	}
+	return
+}
+
+func (p *Pool) release(c *pooledContainer, runErr error) {
+	c.uses++
+	// only containers that finished by themselves can run again
+	_, failed := runErr.(*ExitError)
+	reusable := runErr == nil || failed
+
+	p.mu.Lock()
+	p.inUse--
+	if c.returning {
+		c.returning = false
+		p.returning--
+	}
+	if p.closed {
+		p.mu.Unlock()
+		err := p.destroy(c)
+		if err != nil {
+			log.Errorln(err)
+		}
+		return
+	}
+	if reusable && c.uses < p.opts.MaxUses && len(p.idle) < p.opts.Size {
+		c.idleSince = time.Now()
+		p.idle = append(p.idle, c)
+	} else {
+		p.replace(c)
+	}
+	p.mu.Unlock()
+}
+
+// expired reports whether the idle container must not be used anymore
+func (p *Pool) expired(c *pooledContainer, now time.Time) bool {
+	return p.opts.IdleTTL > 0 && now.Sub(c.idleSince) > p.opts.IdleTTL
+}
+
+// replace destroys the container and creates another one in background,
+// it must be called with p.mu held
+func (p *Pool) replace(c *pooledContainer) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := p.destroy(c)
+		if err != nil {
+			log.Errorln(err)
+		}
+		err = p.fill(context.Background())
+		if err != nil {
+			log.Errorf("error trying to fill the pool %v\n", err.Error())
+		}
+	}()
+}
+
+// refill creates containers in background until the pool has opts.Size
+// idle ones, it must be called with p.mu held
+func (p *Pool) refill() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := p.fill(context.Background())
+		if err != nil {
+			log.Errorf("error trying to fill the pool %v\n", err.Error())
+		}
+	}()
+}
+
+// fill creates containers until the pool has opts.Size idle ones
+func (p *Pool) fill(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle)+p.creating+p.returning >= p.opts.Size {
+			p.mu.Unlock()
+			return nil
+		}
+		p.creating++
+		p.mu.Unlock()
+
+		c, err := p.create(ctx)
+
+		p.mu.Lock()
+		p.creating--
+		closed := p.closed
+		if err == nil && !closed {
+			c.idleSince = time.Now()
+			p.idle = append(p.idle, c)
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if closed {
+			return p.destroy(c)
+		}
+	}
+}
+
+func (p *Pool) create(ctx context.Context) (c *pooledContainer, err error) {
+	containerOpts := p.containerOpts
+	container, err := PrepareContainer(ctx, p.rt, p.buildOpts, &containerOpts)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.stats.Created++
+	p.mu.Unlock()
+	c = &pooledContainer{id: container.ID}
+	return
+}
+
+func (p *Pool) destroy(c *pooledContainer) error {
+	err := destroyContainer(p.rt, c.id)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.stats.Destroyed++
+	p.mu.Unlock()
+	return nil
+}
+
+// evictLoop replaces the containers idle for longer than opts.IdleTTL
+func (p *Pool) evictLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(tickInterval(p.opts.IdleTTL))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			if p.closed {
+				p.mu.Unlock()
+				return
+			}
+			idle := p.idle[:0]
+			for _, c := range p.idle {
+				if p.expired(c, now) {
+					p.replace(c)
+					continue
+				}
+				idle = append(idle, c)
+			}
+			p.idle = idle
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gofn
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	fake "github.com/fsouza/go-dockerclient/testing"
+	"github.com/gofn/gofn/gofntest"
+	"github.com/gofn/gofn/provision"
+)
+
+func TestPool(t *testing.T) {
+	server, err := fake.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildOpts := &provision.BuildOptions{
+		ContextDir: "./provision/testing_data",
+		ImageName:  "pooltest",
+	}
+	// the fake containers run until they are stopped
+	containerOpts := &provision.ContainerOptions{
+		Timeout:     50 * time.Millisecond,
+		StopTimeout: time.Second,
+	}
+	pool, err := NewPool(context.Background(), provision.NewDockerRuntime(client), buildOpts, containerOpts, PoolOptions{Size: 2})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Idle != 2 || stats.Created != 2 {
+		t.Errorf("expected 2 idle containers but found %+v", stats)
+	}
+
+	_, err = pool.Run(context.Background(), nil)
+	if err != provision.ErrTimeout {
+		t.Errorf("Expected %q but found %q", provision.ErrTimeout, err)
+	}
+	stats = pool.Stats()
+	if stats.Hits != 1 || stats.Misses != 0 || stats.InUse != 0 {
+		t.Errorf("expected one hit and no containers in use but found %+v", stats)
+	}
+
+	err = pool.Close()
+	if err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	stats = pool.Stats()
+	if stats.Idle != 0 || stats.Created != stats.Destroyed {
+		t.Errorf("expected every container to be destroyed but found %+v", stats)
+	}
+
+	_, err = pool.Run(context.Background(), nil)
+	if err != ErrPoolClosed {
+		t.Errorf("Expected %q but found %q", ErrPoolClosed, err)
+	}
+}
+
+// waitStats polls the stats of the pool until ok returns true, the pool
+// replaces and refills its containers in background
+func waitStats(t *testing.T, pool *Pool, ok func(PoolStats) bool) PoolStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := pool.Stats()
+		if ok(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected pool stats %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolMaxUses(t *testing.T) {
+	rt := gofntest.NewRuntime()
+	rt.On("gofn/hello", gofntest.Behavior{Stdout: "hello"})
+	pool, err := NewPool(context.Background(), rt, &provision.BuildOptions{ImageName: "hello"}, nil, PoolOptions{Size: 1, MaxUses: 2})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		result, runErr := pool.Run(context.Background(), strings.NewReader("input"))
+		if runErr != nil {
+			t.Fatalf("Expected no errors but %q found", runErr)
+		}
+		if result.Stdout != "hello" {
+			t.Errorf("Expected %q but found %q", "hello", result.Stdout)
+		}
+		ids = append(ids, result.ContainerID)
+		waitStats(t, pool, func(s PoolStats) bool { return s.Idle == 1 })
+	}
+	if ids[0] != ids[1] || ids[1] == ids[2] {
+		t.Errorf("expected a container to serve 2 invocations but found %v", ids)
+	}
+	stats := pool.Stats()
+	if stats.Hits != 3 || stats.Misses != 0 || stats.Created != 2 || stats.Destroyed != 1 {
+		t.Errorf("expected 3 hits in 2 containers but found %+v", stats)
+	}
+
+	if err = pool.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestPoolIdleTTL(t *testing.T) {
+	rt := gofntest.NewRuntime()
+	pool, err := NewPool(context.Background(), rt, &provision.BuildOptions{ImageName: "hello"}, nil, PoolOptions{Size: 1, IdleTTL: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	// the idle container is replaced by a new one
+	waitStats(t, pool, func(s PoolStats) bool { return s.Destroyed >= 1 && s.Idle == 1 })
+
+	if err = pool.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	stats := pool.Stats()
+	if stats.Created != stats.Destroyed {
+		t.Errorf("expected every container to be destroyed but found %+v", stats)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestPoolMiss(t *testing.T) {
+	rt := gofntest.NewRuntime()
+	rt.On("gofn/hello", gofntest.Behavior{Stdout: "hello"})
+	pool, err := NewPool(context.Background(), rt, &provision.BuildOptions{ImageName: "hello"}, nil, PoolOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	result, err := pool.Run(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Stdout != "hello" {
+		t.Errorf("Expected %q but found %q", "hello", result.Stdout)
+	}
+	// without idle containers the one created for the invocation is
+	// destroyed once it finishes
+	stats := waitStats(t, pool, func(s PoolStats) bool { return s.Destroyed == 1 })
+	if stats.Hits != 0 || stats.Misses != 1 || stats.Created != 1 || stats.Idle != 0 {
+		t.Errorf("expected a miss and no idle containers but found %+v", stats)
+	}
+	if err = pool.Close(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestPoolIsolatedNetwork(t *testing.T) {
+	rt := gofntest.NewRuntime()
+	_, err := NewPool(context.Background(), rt, &provision.BuildOptions{ImageName: "hello"}, &provision.ContainerOptions{IsolatedNetwork: true}, PoolOptions{Size: 1})
+	if err != provision.ErrNotSupported {
+		t.Errorf("Expected %q but found %q", provision.ErrNotSupported, err)
+	}
+	if n := rt.CallCount("CreateContainer"); n != 0 {
+		t.Errorf("expected no containers created but found %d", n)
+	}
+}
@@ -0,0 +1,129 @@
+package provision
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DefaultHealthCheckInterval is how long a cached client is used before it
+// is pinged again
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// pingTimeout bounds the health check of a cached client
+const pingTimeout = 5 * time.Second
+
+// ClientCache keeps one docker client for each endpoint, so the runs on the
+// same daemon share its connection pool. The zero value is an empty cache
+// and it is safe for concurrent use
+type ClientCache struct {
+	// HealthCheckInterval is how long a client is used without pinging the
+	// daemon, a client whose ping fails is replaced. Zero means
+	// DefaultHealthCheckInterval
+	HealthCheckInterval time.Duration
+
+	mu      sync.Mutex
+	clients map[DockerEndpoint]*cachedClient
+}
+
+type cachedClient struct {
+	client  *docker.Client
+	checked time.Time
+}
+
+// NewClientCache returns an empty cache
+func NewClientCache() *ClientCache {
+	return &ClientCache{clients: make(map[DockerEndpoint]*cachedClient)}
+}
+
+// Client returns the cached client of the endpoint, a new client is created
+// when there is none or the daemon does not answer the health check. The
+// health check is canceled with ctx
+func (c *ClientCache) Client(ctx context.Context, endpoint DockerEndpoint) (*docker.Client, error) {
+	c.mu.Lock()
+	cached, ok := c.clients[endpoint]
+	var checked time.Time
+	if ok {
+		checked = cached.checked
+	}
+	c.mu.Unlock()
+	if ok {
+		if time.Since(checked) < c.healthCheckInterval() {
+			return cached.client, nil
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := cached.client.PingWithContext(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			// the caller gave up, the client is not known to be unhealthy
+			return nil, ctx.Err()
+		}
+		healthy := err == nil
+		c.mu.Lock()
+		if healthy {
+			cached.checked = time.Now()
+		} else if c.clients[endpoint] == cached {
+			delete(c.clients, endpoint)
+		}
+		c.mu.Unlock()
+		if healthy {
+			return cached.client, nil
+		}
+		closeIdleConnections(cached.client)
+	}
+
+	client, err := endpoint.Client()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another goroutine may have created the client meanwhile
+	if cached, ok = c.clients[endpoint]; ok {
+		return cached.client, nil
+	}
+	if c.clients == nil {
+		c.clients = make(map[DockerEndpoint]*cachedClient)
+	}
+	c.clients[endpoint] = &cachedClient{client: client, checked: time.Now()}
+	return client, nil
+}
+
+// FnClient returns the cached client like the FnClient function
+func (c *ClientCache) FnClient(ctx context.Context, endPoint, certsDir string) (*docker.Client, error) {
+	if endPoint == "" {
+		endPoint = defaultEndpoint
+	}
+	return c.Client(ctx, DockerEndpoint{Host: endPoint, TLS: certsDir != "", CertsDir: certsDir})
+}
+
+// Remove drops the client of the endpoint from the cache and closes its
+// idle connections
+func (c *ClientCache) Remove(endpoint DockerEndpoint) {
+	c.mu.Lock()
+	cached, ok := c.clients[endpoint]
+	delete(c.clients, endpoint)
+	c.mu.Unlock()
+	if ok {
+		closeIdleConnections(cached.client)
+	}
+}
+
+func (c *ClientCache) healthCheckInterval() time.Duration {
+	if c.HealthCheckInterval > 0 {
+		return c.HealthCheckInterval
+	}
+	return DefaultHealthCheckInterval
+}
+
+func closeIdleConnections(client *docker.Client) {
+	if client.HTTPClient == nil {
+		return
+	}
+	if t, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,101 @@
+package provision
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClientCache(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	other := createFakeDockerAPI(t)
+	defer other.Stop()
+
+	cache := NewClientCache()
+	endpoint := DockerEndpoint{Host: server.URL()}
+	client, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	cached, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if cached != client {
+		t.Error("expected the cached client to be reused")
+	}
+	otherClient, err := cache.FnClient(context.Background(), other.URL(), "")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if otherClient == client {
+		t.Error("expected a client for each endpoint")
+	}
+
+	cache.Remove(endpoint)
+	cached, err = cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if cached == client {
+		t.Error("expected a new client after the endpoint was removed")
+	}
+}
+
+func TestClientCacheHealthCheck(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	cache := &ClientCache{HealthCheckInterval: time.Nanosecond}
+	endpoint := DockerEndpoint{Host: server.URL()}
+	client, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	time.Sleep(time.Millisecond)
+	cached, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if cached != client {
+		t.Error("expected a healthy client to be reused")
+	}
+
+	server.PrepareFailure("ping", "/_ping")
+	defer server.ResetFailure("ping")
+	time.Sleep(time.Millisecond)
+	cached, err = cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if cached == client {
+		t.Error("expected the client to be replaced after a failed health check")
+	}
+}
+
+func TestClientCacheHealthCheckCanceled(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	cache := &ClientCache{HealthCheckInterval: time.Nanosecond}
+	endpoint := DockerEndpoint{Host: server.URL()}
+	client, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	time.Sleep(time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.Client(ctx, endpoint)
+	if err != context.Canceled {
+		t.Errorf("Expected %q but %q found", context.Canceled, err)
+	}
+	cached, err := cache.Client(context.Background(), endpoint)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if cached != client {
+		t.Error("expected the client to be kept after a canceled health check")
+	}
+}
@@ -0,0 +1,666 @@
+//+build linux
+
+// Package containerd runs gofn functions on containerd, without the Docker
+// daemon. Images are pulled into a containerd namespace and each container
+// runs as a task whose stdio is connected through FIFOs.
+//
+// The containers get the default seccomp profile of containerd, as the
+// Docker daemon applies its own default profile, so the same
+// provision.ContainerOptions restrict a container alike on both runtimes.
+package containerd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	remotesdocker "github.com/containerd/containerd/remotes/docker"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gofn/gofn/provision"
+	"github.com/gofrs/uuid"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// DefaultAddress is the socket of the containerd API
+	DefaultAddress = "/run/containerd/containerd.sock"
+
+	// DefaultNamespace isolates the images and containers of gofn from the
+	// ones of other containerd clients
+	DefaultNamespace = "gofn"
+)
+
+// ErrNoTask is raised when the container was not started
+var ErrNoTask = errors.New("containerd: container has no task")
+
+type task struct {
+	oom bool
+	// cancel stops watching the task for out of memory events
+	cancel context.CancelFunc
+}
+
+// Runtime is the provision.Runtime backed by containerd. It has no network
+// other than the loopback, unless ContainerOptions.NetworkMode is
+// provision.NetworkHost, and it does not keep the logs of the containers
+type Runtime struct {
+	client    *containerd.Client
+	namespace string
+
+	mu    sync.Mutex
+	tasks map[string]*task
+}
+
+var _ provision.Runtime = &Runtime{}
+
+// New connects to containerd at address, DefaultAddress and
+// DefaultNamespace are used when address and namespace are empty
+func New(address, namespace string) (*Runtime, error) {
+	if address == "" {
+		address = DefaultAddress
+	}
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	return &Runtime{
+		client:    client,
+		namespace: namespace,
+		tasks:     make(map[string]*task),
+	}, nil
+}
+
+// Close closes the connection to containerd
+func (r *Runtime) Close() error {
+	return r.client.Close()
+}
+
+// BuildImage pulls the image when opts.ForcePull is set or the context has
+// no Dockerfile, containerd can not build images so ErrNotSupported is
+// returned otherwise
+func (r *Runtime) BuildImage(ctx context.Context, opts *provision.BuildOptions) (string, error) {
+	if !opts.ForcePull {
+		if opts.RemoteURI != "" {
+			return "", provision.ErrNotSupported
+		}
+		dockerfile := opts.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		contextDir := opts.ContextDir
+		if contextDir == "" {
+			contextDir = "./"
+		}
+		if _, err := os.Stat(filepath.Join(contextDir, dockerfile)); err == nil {
+			return "", provision.ErrNotSupported
+		}
+	}
+	err := r.PullImage(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	return opts.GetImageName(), nil
+}
+
+// PullImage pulls and unpacks the image into the namespace
+func (r *Runtime) PullImage(ctx context.Context, opts *provision.BuildOptions) error {
+	ref, err := reference(opts.GetImageName())
+	if err != nil {
+		return err
+	}
+	pullOpts := []containerd.RemoteOpt{containerd.WithPullUnpack}
+	if opts.Auth.Username != "" || opts.Auth.Password != "" {
+		auth := opts.Auth
+		pullOpts = append(pullOpts, containerd.WithResolver(remotesdocker.NewResolver(remotesdocker.ResolverOptions{
+			Credentials: func(string) (string, string, error) {
+				return auth.Username, auth.Password, nil
+			},
+		})))
+	}
+	_, err = r.client.Pull(r.context(ctx), ref, pullOpts...)
+	return err
+}
+
+// FindImage returns provision.ErrImageNotFound when the image was not pulled
+func (r *Runtime) FindImage(ctx context.Context, name string) (provision.Image, error) {
+	ref, err := reference(name)
+	if err != nil {
+		return provision.Image{}, err
+	}
+	image, err := r.client.GetImage(r.context(ctx), ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			err = provision.ErrImageNotFound
+		}
+		return provision.Image{}, err
+	}
+	return provision.Image{ID: image.Target().Digest.String(), Name: name}, nil
+}
+
+// CreateContainer creates the container and its snapshot from the image,
+// the container runs when it is started
+func (r *Runtime) CreateContainer(ctx context.Context, opts provision.ContainerOptions) (*provision.Container, error) {
+	specOpts, err := specOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := reference(opts.Image)
+	if err != nil {
+		return nil, err
+	}
+	ctx = r.context(ctx)
+	image, err := r.client.GetImage(ctx, ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			err = provision.ErrImageNotFound
+		}
+		return nil, err
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("gofn-%s", uid.String())
+	labels := provision.ContainerLabels(opts, uid.String())
+	containerOpts := []containerd.NewContainerOpts{
+		containerd.WithImage(image),
+		containerd.WithContainerLabels(labels),
+		containerd.WithNewSnapshot(id, image),
+		containerd.WithNewSpec(append([]oci.SpecOpts{oci.WithImageConfigArgs(image, opts.Cmd)}, specOpts...)...),
+	}
+	if opts.Runtime != "" {
+		containerOpts = append(containerOpts, containerd.WithRuntime(opts.Runtime, nil))
+	}
+	container, err := r.client.NewContainer(ctx, id, containerOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &provision.Container{
+		ID:      container.ID(),
+		Name:    container.ID(),
+		Image:   opts.Image,
+		ImageID: image.Target().Digest.String(),
+		Created: time.Now(),
+		Labels:  labels,
+	}, nil
+}
+
+// StartContainer starts the task of the container, a task without stdio is
+// created when the container was not attached or its task exited
+func (r *Runtime) StartContainer(ctx context.Context, containerID string) error {
+	ctx = r.context(ctx)
+	t, err := r.task(ctx, containerID)
+	if err == nil {
+		var status containerd.Status
+		status, err = t.Status(ctx)
+		if err == nil && status.Status == containerd.Stopped {
+			err = ErrNoTask
+		}
+	}
+	if err == ErrNoTask {
+		t, err = r.newTask(ctx, containerID, cio.NullIO)
+	}
+	if err != nil {
+		return err
+	}
+	return t.Start(ctx)
+}
+
+// AttachContainer creates the task of the container with its stdio
+// connected to the streams, so it must be called before StartContainer.
+// The task of a container which exited is replaced, so the container runs
+// again like a restarted docker container
+func (r *Runtime) AttachContainer(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (provision.CloseWaiter, error) {
+	t, err := r.newTask(r.context(ctx), containerID, cio.NewCreator(cio.WithStreams(stdin, stdout, stderr)))
+	if err != nil {
+		return nil, err
+	}
+	return &attachment{io: t.IO()}, nil
+}
+
+// WaitContainer waits the task to exit and returns its exit code
+func (r *Runtime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	ctx = r.context(ctx)
+	t, err := r.task(ctx, containerID)
+	if err != nil {
+		return 0, err
+	}
+	statusC, err := t.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		return int(code), err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// InspectContainer returns provision.ErrContainerNotFound when the
+// container does not exist
+func (r *Runtime) InspectContainer(ctx context.Context, containerID string) (*provision.Container, error) {
+	ctx = r.context(ctx)
+	container, err := r.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	c := &provision.Container{
+		ID:      info.ID,
+		Name:    info.ID,
+		Image:   info.Image,
+		Created: info.CreatedAt,
+	}
+	t, err := container.Task(ctx, nil)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	status, err := t.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.State.Running = status.Status == containerd.Running
+	if status.Status == containerd.Stopped {
+		c.State.ExitCode = int(status.ExitStatus)
+		c.State.FinishedAt = status.ExitTime
+	}
+	r.mu.Lock()
+	if t, ok := r.tasks[containerID]; ok {
+		c.State.OOMKilled = t.oom
+	}
+	r.mu.Unlock()
+	return c, nil
+}
+
+// Logs is not supported, containerd does not keep the output of tasks
+func (r *Runtime) Logs(ctx context.Context, containerID string, stdout io.Writer, stderr io.Writer) error {
+	return provision.ErrNotSupported
+}
+
+// KillContainer sends the signal to the task of the container
+func (r *Runtime) KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error {
+	ctx = r.context(ctx)
+	t, err := r.task(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	return notFound(t.Kill(ctx, signal))
+}
+
+// RemoveContainer kills and deletes the task, then deletes the container
+// and its snapshot
+func (r *Runtime) RemoveContainer(ctx context.Context, containerID string) error {
+	ctx = r.context(ctx)
+	container, err := r.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return notFound(err)
+	}
+	t, err := container.Task(ctx, nil)
+	if err == nil {
+		_, err = t.Delete(ctx, containerd.WithProcessKill)
+	}
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	r.mu.Lock()
+	if t, ok := r.tasks[containerID]; ok {
+		t.cancel()
+		delete(r.tasks, containerID)
+	}
+	r.mu.Unlock()
+	return notFound(container.Delete(ctx, containerd.WithSnapshotCleanup))
+}
+
+// ListContainers lists the containers created by gofn in the namespace,
+// found by their provision.LabelVersion
+func (r *Runtime) ListContainers(ctx context.Context) ([]provision.Container, error) {
+	ctx = r.context(ctx)
+	list, err := r.client.Containers(ctx, fmt.Sprintf("labels.%q", provision.LabelVersion))
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]provision.Container, 0, len(list))
+	for _, container := range list {
+		info, err := container.Info(ctx)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		c := provision.Container{
+			ID:      info.ID,
+			Name:    info.ID,
+			Image:   info.Image,
+			Created: info.CreatedAt,
+			Labels:  info.Labels,
+		}
+		if t, err := container.Task(ctx, nil); err == nil {
+			status, err := t.Status(ctx)
+			c.State.Running = err == nil && status.Status == containerd.Running
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// context sets the namespace of the runtime in ctx
+func (r *Runtime) context(ctx context.Context) context.Context {
+	return namespaces.WithNamespace(ctx, r.namespace)
+}
+
+func (r *Runtime) task(ctx context.Context, containerID string) (containerd.Task, error) {
+	container, err := r.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	t, err := container.Task(ctx, nil)
+	if errdefs.IsNotFound(err) {
+		return nil, ErrNoTask
+	}
+	return t, err
+}
+
+// newTask creates the task of the container and watches it for out of
+// memory events until the container is removed, the stopped task of a
+// previous run is deleted first
+func (r *Runtime) newTask(ctx context.Context, containerID string, ioCreator cio.Creator) (containerd.Task, error) {
+	container, err := r.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	err = r.deleteStopped(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	t, err := container.NewTask(ctx, ioCreator)
+	if err != nil {
+		return nil, err
+	}
+
+	// the events outlive the request that created the task
+	watchCtx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), r.namespace))
+	state := &task{cancel: cancel}
+	r.mu.Lock()
+	if old, ok := r.tasks[containerID]; ok {
+		old.cancel()
+	}
+	r.tasks[containerID] = state
+	r.mu.Unlock()
+	events, errs := r.client.Subscribe(watchCtx, fmt.Sprintf(`topic=="/tasks/oom",event.container_id==%q`, containerID))
+	go func() {
+		select {
+		case <-events:
+			r.mu.Lock()
+			state.oom = true
+			r.mu.Unlock()
+		case <-errs:
+		case <-watchCtx.Done():
+		}
+	}()
+	return t, nil
+}
+
+// deleteStopped deletes the task of the container when it exited
+func (r *Runtime) deleteStopped(ctx context.Context, container containerd.Container) error {
+	t, err := container.Task(ctx, nil)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	status, err := t.Status(ctx)
+	if err != nil || status.Status != containerd.Stopped {
+		return err
+	}
+	_, err = t.Delete(ctx)
+	return err
+}
+
+// attachment is the stdio of a task
+type attachment struct {
+	io cio.IO
+}
+
+func (a *attachment) Close() error {
+	a.io.Cancel()
+	return a.io.Close()
+}
+
+func (a *attachment) Wait() error {
+	a.io.Wait()
+	return nil
+}
+
+// reference returns the fully qualified name of the image, like
+// docker.io/gofn/python:latest for gofn/python
+func reference(name string) (string, error) {
+	named, err := refdocker.ParseDockerRef(name)
+	if err != nil {
+		return "", err
+	}
+	return named.String(), nil
+}
+
+func notFound(err error) error {
+	if errdefs.IsNotFound(err) {
+		return provision.ErrContainerNotFound
+	}
+	return err
+}
+
+// specOpts converts the options which do not depend on the image into
+// options of the OCI spec, provision.ErrNotSupported is returned for the
+// networking options because containerd does not manage networks. The
+// default seccomp profile is applied last because it allows the syscalls
+// of the capabilities kept
+func specOpts(opts provision.ContainerOptions) ([]oci.SpecOpts, error) {
+	var specOpts []oci.SpecOpts
+	switch opts.NetworkMode {
+	case "", provision.NetworkNone:
+	case provision.NetworkHost:
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostHostsFile, oci.WithHostResolvconf)
+	default:
+		return nil, provision.ErrNotSupported
+	}
+	if opts.IsolatedNetwork || len(opts.PortBindings) > 0 || len(opts.DNS) > 0 || len(opts.ExtraHosts) > 0 {
+		return nil, provision.ErrNotSupported
+	}
+
+	if len(opts.Env) > 0 {
+		specOpts = append(specOpts, oci.WithEnv(opts.Env))
+	}
+	mounts, err := mounts(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(mounts) > 0 {
+		specOpts = append(specOpts, oci.WithMounts(mounts))
+	}
+
+	if opts.Memory > 0 {
+		specOpts = append(specOpts, oci.WithMemoryLimit(uint64(opts.Memory)))
+	}
+	if opts.MemorySwap != 0 {
+		specOpts = append(specOpts, withMemorySwap(opts.MemorySwap))
+	}
+	if opts.CPUShares > 0 {
+		specOpts = append(specOpts, oci.WithCPUShares(uint64(opts.CPUShares)))
+	}
+	if opts.CPUQuota > 0 || opts.CPUPeriod > 0 {
+		specOpts = append(specOpts, oci.WithCPUCFS(opts.CPUQuota, uint64(opts.CPUPeriod)))
+	}
+	if opts.CPUSetCPUs != "" {
+		specOpts = append(specOpts, oci.WithCPUs(opts.CPUSetCPUs))
+	}
+	if opts.PidsLimit > 0 {
+		specOpts = append(specOpts, oci.WithPidsLimit(opts.PidsLimit))
+	}
+	if len(opts.Ulimits) > 0 {
+		specOpts = append(specOpts, withUlimits(opts.Ulimits))
+	}
+
+	if opts.User != "" {
+		specOpts = append(specOpts, oci.WithUser(opts.User))
+	}
+	if len(opts.GroupAdd) > 0 {
+		gids := make([]uint32, 0, len(opts.GroupAdd))
+		for _, group := range opts.GroupAdd {
+			gid, err := strconv.ParseUint(group, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("containerd: group %q must be numeric", group)
+			}
+			gids = append(gids, uint32(gid))
+		}
+		specOpts = append(specOpts, withAdditionalGIDs(gids))
+	}
+	if opts.ReadOnlyRootfs {
+		specOpts = append(specOpts, oci.WithRootFSReadonly())
+	}
+	if len(opts.CapDrop) > 0 {
+		specOpts = append(specOpts, withDroppedCapabilities(capabilities(opts.CapDrop)))
+	}
+	if len(opts.CapAdd) > 0 {
+		specOpts = append(specOpts, oci.WithAddedCapabilities(capabilities(opts.CapAdd)))
+	}
+	for _, opt := range opts.SecurityOpt {
+		switch opt {
+		case "no-new-privileges", "no-new-privileges:true":
+			specOpts = append(specOpts, oci.WithNoNewPrivileges)
+		default:
+			return nil, provision.ErrNotSupported
+		}
+	}
+	specOpts = append(specOpts, seccomp.WithDefaultProfile())
+	return specOpts, nil
+}
+
+// mounts converts the volumes, in the source:destination[:options] format,
+// and the tmpfs mounts
+func mounts(opts provision.ContainerOptions) ([]specs.Mount, error) {
+	var mounts []specs.Mount
+	for _, volume := range opts.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("containerd: invalid volume %q", volume)
+		}
+		options := []string{"rbind", "rw"}
+		if len(parts) == 3 {
+			options = []string{"rbind"}
+			options = append(options, strings.Split(parts[2], ",")...)
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: parts[1],
+			Type:        "bind",
+			Source:      parts[0],
+			Options:     options,
+		})
+	}
+	for destination, options := range opts.Tmpfs {
+		mount := specs.Mount{
+			Destination: destination,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+		}
+		if options != "" {
+			mount.Options = strings.Split(options, ",")
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// capabilities adds the CAP_ prefix used by the OCI spec
+func capabilities(caps []string) []string {
+	names := make([]string, 0, len(caps))
+	for _, c := range caps {
+		c = strings.ToUpper(c)
+		if c != "ALL" && !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		names = append(names, c)
+	}
+	return names
+}
+
+func withDroppedCapabilities(caps []string) oci.SpecOpts {
+	for _, c := range caps {
+		if c == "ALL" {
+			return oci.WithCapabilities(nil)
+		}
+	}
+	return oci.WithDroppedCapabilities(caps)
+}
+
+func withMemorySwap(swap int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		resources(s)
+		if s.Linux.Resources.Memory == nil {
+			s.Linux.Resources.Memory = &specs.LinuxMemory{}
+		}
+		s.Linux.Resources.Memory.Swap = &swap
+		return nil
+	}
+}
+
+func withUlimits(ulimits []docker.ULimit) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		for _, ulimit := range ulimits {
+			s.Process.Rlimits = append(s.Process.Rlimits, specs.POSIXRlimit{
+				Type: "RLIMIT_" + strings.ToUpper(ulimit.Name),
+				Hard: uint64(ulimit.Hard),
+				Soft: uint64(ulimit.Soft),
+			})
+		}
+		return nil
+	}
+}
+
+func withAdditionalGIDs(gids []uint32) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		s.Process.User.AdditionalGids = append(s.Process.User.AdditionalGids, gids...)
+		return nil
+	}
+}
+
+func resources(s *oci.Spec) {
+	if s.Linux == nil {
+		s.Linux = &specs.Linux{}
+	}
+	if s.Linux.Resources == nil {
+		s.Linux.Resources = &specs.LinuxResources{}
+	}
+}
@@ -0,0 +1,177 @@
+//+build linux
+
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/gofn/gofn/provision"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func applySpecOpts(t *testing.T, opts provision.ContainerOptions) *oci.Spec {
+	specOpts, err := specOpts(opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	s := &oci.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: []string{"CAP_CHOWN"}}},
+		Root:    &specs.Root{},
+		Linux:   &specs.Linux{},
+	}
+	for _, opt := range specOpts {
+		if err = opt(context.Background(), nil, &containers.Container{}, s); err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+	}
+	return s
+}
+
+func TestSpecOptsHardenedDefaults(t *testing.T) {
+	s := applySpecOpts(t, provision.HardenedDefaults())
+
+	if s.Process.User.UID != 65534 || s.Process.User.GID != 65534 {
+		t.Errorf("expected user 65534:65534 but found %+v", s.Process.User)
+	}
+	if !s.Root.Readonly {
+		t.Error("expected a read only root filesystem")
+	}
+	if !s.Process.NoNewPrivileges {
+		t.Error("expected no new privileges")
+	}
+	if len(s.Process.Capabilities.Bounding) != 0 {
+		t.Errorf("expected every capability dropped but found %v", s.Process.Capabilities.Bounding)
+	}
+	if s.Linux.Seccomp == nil {
+		t.Error("expected the default seccomp profile")
+	}
+	if s.Linux.Resources.Pids == nil || s.Linux.Resources.Pids.Limit != 256 {
+		t.Errorf("expected pids limit 256 but found %+v", s.Linux.Resources.Pids)
+	}
+	if len(s.Mounts) != 1 || s.Mounts[0].Destination != "/tmp" || s.Mounts[0].Type != "tmpfs" {
+		t.Errorf("expected a tmpfs mounted in /tmp but found %+v", s.Mounts)
+	}
+}
+
+func TestSpecOptsResources(t *testing.T) {
+	s := applySpecOpts(t, provision.ContainerOptions{
+		Env:        []string{"A=1"},
+		Volumes:    []string{"/src:/dst:ro"},
+		Memory:     64 * 1024 * 1024,
+		MemorySwap: 128 * 1024 * 1024,
+		GroupAdd:   []string{"10"},
+	})
+
+	if len(s.Process.Env) != 1 || s.Process.Env[0] != "A=1" {
+		t.Errorf("expected the environment to be set but found %v", s.Process.Env)
+	}
+	if len(s.Mounts) != 1 || s.Mounts[0].Source != "/src" || s.Mounts[0].Destination != "/dst" || strings.Join(s.Mounts[0].Options, ",") != "rbind,ro" {
+		t.Errorf("expected a read only bind mount but found %+v", s.Mounts)
+	}
+	memory := s.Linux.Resources.Memory
+	if memory == nil || memory.Limit == nil || *memory.Limit != 64*1024*1024 || memory.Swap == nil || *memory.Swap != 128*1024*1024 {
+		t.Errorf("expected the memory limits to be set but found %+v", memory)
+	}
+	if len(s.Process.User.AdditionalGids) != 1 || s.Process.User.AdditionalGids[0] != 10 {
+		t.Errorf("expected the additional group 10 but found %v", s.Process.User.AdditionalGids)
+	}
+}
+
+func TestSpecOptsNotSupported(t *testing.T) {
+	var tt = []provision.ContainerOptions{
+		{NetworkMode: provision.NetworkBridge},
+		{IsolatedNetwork: true},
+		{DNS: []string{"8.8.8.8"}},
+		{SecurityOpt: []string{"seccomp=unconfined"}},
+	}
+	for _, opts := range tt {
+		if _, err := specOpts(opts); err != provision.ErrNotSupported {
+			t.Errorf("%+v: Expected %q but found %q", opts, provision.ErrNotSupported, err)
+		}
+	}
+	if _, err := specOpts(provision.ContainerOptions{GroupAdd: []string{"staff"}}); err == nil {
+		t.Error("expecting errors for a group name, but nothing found")
+	}
+}
+
+func TestReference(t *testing.T) {
+	var tt = []struct {
+		name string
+		ref  string
+	}{
+		{"gofn/python", "docker.io/gofn/python:latest"},
+		{"alpine", "docker.io/library/alpine:latest"},
+		{"registry.example.com/fn:1", "registry.example.com/fn:1"},
+	}
+	for _, tc := range tt {
+		ref, err := reference(tc.name)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if ref != tc.ref {
+			t.Errorf("expected %q but found %q", tc.ref, ref)
+		}
+	}
+}
+
+func TestRuntimeIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	if _, err := os.Stat(DefaultAddress); err != nil || os.Getuid() != 0 {
+		t.Skip("skipping containerd integration test, containerd socket not available")
+	}
+	rt, err := New("", "gofn-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	ctx := context.Background()
+	name, err := rt.BuildImage(ctx, &provision.BuildOptions{
+		ImageName:               "alpine:3.8",
+		DoNotUsePrefixImageName: true,
+		ForcePull:               true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tt = []struct {
+		cmd    []string
+		stdout string
+		code   int
+	}{
+		{[]string{"cat"}, "test", 0},
+		{[]string{"sh", "-c", "exit 3"}, "", 3},
+	}
+	for _, tc := range tt {
+		c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: name, Cmd: tc.cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := new(bytes.Buffer)
+		err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{Stdin: strings.NewReader("test")}, stdout, nil)
+		if tc.code == 0 && err != nil {
+			t.Errorf("Expected no errors but %q found", err)
+		}
+		if exitErr, ok := err.(*provision.ExitError); tc.code != 0 && (!ok || exitErr.Code != tc.code) {
+			t.Errorf("expected exit status %d but found %v", tc.code, err)
+		}
+		if stdout.String() != tc.stdout {
+			t.Errorf("expected %q but found %q", tc.stdout, stdout.String())
+		}
+		if err = rt.RemoveContainer(ctx, c.ID); err != nil {
+			t.Errorf("Expected no errors but %q found", err)
+		}
+		if _, err = rt.InspectContainer(ctx, c.ID); err != provision.ErrContainerNotFound {
+			t.Errorf("Expected %q but found %q", provision.ErrContainerNotFound, err)
+		}
+	}
+}
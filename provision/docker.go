@@ -2,11 +2,14 @@ package provision
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gofn/gofn/iaas"
@@ -20,11 +23,44 @@ var (
 	// ErrContainerNotFound is raised when image is not found
 	ErrContainerNotFound = errors.New("provision: container not found")
 
-	// ErrContainerExecutionFailed is raised if container exited with status different of zero
+	// ErrContainerExecutionFailed was raised if container exited with status different of zero
+	//
+	// Deprecated: an *ExitError holding the exit status is raised instead,
+	// errors.Is still matches it with ErrContainerExecutionFailed
 	ErrContainerExecutionFailed = errors.New("provision: container exited with failure")
 
-	// Input receives a string that will be written to the stdin of the container in function FnRun
-	Input string
+	// ErrOOMKilled is raised if container was killed because it reached its memory limit
+	ErrOOMKilled = errors.New("provision: container killed by out of memory")
+
+	// ErrTimeout is raised if container was stopped because it ran longer than its timeout
+	ErrTimeout = errors.New("provision: container stopped by timeout")
+)
+
+// defaultStopTimeout is the grace period between SIGTERM and SIGKILL, the
+// same used by docker stop
+const defaultStopTimeout = 10 * time.Second
+
+// ExitError is raised if container exited with status different of zero
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("provision: container exited with status %d", e.Code)
+}
+
+// Is matches the deprecated ErrContainerExecutionFailed, which was raised
+// before ExitError
+func (e *ExitError) Is(target error) bool {
+	return target == ErrContainerExecutionFailed
+}
+
+// Network modes accepted by ContainerOptions.NetworkMode, the name of an
+// existing network is also accepted
+const (
+	NetworkNone   = "none"
+	NetworkBridge = "bridge"
+	NetworkHost   = "host"
 )
 
 // BuildOptions are options used in the image build
@@ -34,10 +70,14 @@ type BuildOptions struct {
 	DoNotUsePrefixImageName bool
 	ImageName               string
 	RemoteURI               string
-	StdIN                   string
+	StdIN                   string // Deprecated: use ContainerOptions.Stdin
 	Iaas                    iaas.Iaas
 	Auth                    docker.AuthConfiguration
 	ForcePull               bool
+	// Labels are added to the labels of the built image, Owner is set in
+	// LabelOwner, see ImageLabels
+	Labels map[string]string
+	Owner  string
 }
 
 // ContainerOptions are options used in container
@@ -47,6 +87,82 @@ type ContainerOptions struct {
 	Image   string
 	Env     []string
 	Runtime string
+	// Stdin is streamed to the stdin of the container when it runs, the
+	// stdin is closed once Stdin returns EOF
+	Stdin io.Reader
+
+	// Memory and MemorySwap are limits in bytes, MemorySwap is the total of
+	// memory plus swap and -1 allows unlimited swap
+	Memory     int64
+	MemorySwap int64
+	// CPUShares is the relative weight against other containers, CPUQuota
+	// and CPUPeriod are microseconds and limit the CPU time in each period
+	CPUShares  int64
+	CPUQuota   int64
+	CPUPeriod  int64
+	CPUSetCPUs string
+	// PidsLimit limits the number of processes, zero means unlimited
+	PidsLimit int64
+	Ulimits   []docker.ULimit
+
+	// NetworkMode is one of NetworkNone, NetworkBridge, NetworkHost or the
+	// name of a network, the default bridge is used when it is empty
+	NetworkMode string
+	DNS         []string
+	// ExtraHosts are added to /etc/hosts in the "host:ip" format
+	ExtraHosts []string
+	// PortBindings publishes the container ports on the host, the ports
+	// are exposed automatically
+	PortBindings map[docker.Port][]docker.PortBinding
+	// IsolatedNetwork makes gofn.Run create an internal network only for
+	// this invocation, it is removed with the container and overrides
+	// NetworkMode
+	IsolatedNetwork bool
+
+	// User runs the container as "user", "user:group", "uid" or "uid:gid"
+	// instead of the user of the image, GroupAdd adds supplementary groups
+	User     string
+	GroupAdd []string
+	// ReadOnlyRootfs mounts the root filesystem as read only, Tmpfs adds
+	// writable mounts with their options, e.g. {"/tmp": "rw,noexec,size=64m"}
+	ReadOnlyRootfs bool
+	Tmpfs          map[string]string
+	CapAdd         []string
+	CapDrop        []string
+	// SecurityOpt takes docker security options such as "no-new-privileges",
+	// "seccomp=<profile>" or "apparmor=<profile>"
+	SecurityOpt []string
+
+	// Timeout stops the container when it runs longer than it, zero means
+	// no timeout. StopTimeout is the grace period between SIGTERM and
+	// SIGKILL, 10 seconds when it is zero
+	Timeout     time.Duration
+	StopTimeout time.Duration
+
+	// Labels are added to the labels set by gofn on the container, see
+	// ContainerLabels. InvocationID labels the container with the
+	// invocation which runs it, a new ID is used when it is empty. Owner
+	// tells which service owns the container, the host and the process
+	// creating it as "host:pid" when it is empty
+	Labels       map[string]string
+	InvocationID string
+	Owner        string
+}
+
+// HardenedDefaults returns options to run untrusted functions: a nobody
+// user, a read only root filesystem with a small writable /tmp, no
+// capabilities nor new privileges, no network and limited processes.
+// Fill the remaining options in the returned value before using it
+func HardenedDefaults() ContainerOptions {
+	return ContainerOptions{
+		User:           "65534:65534",
+		ReadOnlyRootfs: true,
+		Tmpfs:          map[string]string{"/tmp": "rw,noexec,nosuid,nodev,size=64m"},
+		CapDrop:        []string{"ALL"},
+		SecurityOpt:    []string{"no-new-privileges"},
+		NetworkMode:    NetworkNone,
+		PidsLimit:      256,
+	}
 }
 
 // GetImageName sets prefix gofn when needed
@@ -65,28 +181,137 @@ func FnRemove(client *docker.Client, containerID string) (err error) {
 
 // FnContainer create container
 func FnContainer(client *docker.Client, opts ContainerOptions) (container *docker.Container, err error) {
+	return createContainer(context.Background(), client, opts)
+}
+
+func createContainer(ctx context.Context, client *docker.Client, opts ContainerOptions) (container *docker.Container, err error) {
 	config := &docker.Config{
 		Image:     opts.Image,
 		Cmd:       opts.Cmd,
 		Env:       opts.Env,
+		User:      opts.User,
 		StdinOnce: true,
 		OpenStdin: true,
 	}
+	if len(opts.PortBindings) > 0 {
+		config.ExposedPorts = make(map[docker.Port]struct{}, len(opts.PortBindings))
+		for port := range opts.PortBindings {
+			config.ExposedPorts[port] = struct{}{}
+		}
+	}
 	var uid uuid.UUID
 	uid, err = uuid.NewV4()
 	if err != nil {
 		return
 	}
+	config.Labels = ContainerLabels(opts, uid.String())
 	container, err = client.CreateContainer(docker.CreateContainerOptions{
 		Name:       fmt.Sprintf("gofn-%s", uid.String()),
-		HostConfig: &docker.HostConfig{Binds: opts.Volumes, Runtime: opts.Runtime},
+		HostConfig: hostConfig(opts),
 		Config:     config,
+		Context:    ctx,
 	})
 	return
 }
 
+func hostConfig(opts ContainerOptions) *docker.HostConfig {
+	config := &docker.HostConfig{
+		Binds:          opts.Volumes,
+		Runtime:        opts.Runtime,
+		Memory:         opts.Memory,
+		MemorySwap:     opts.MemorySwap,
+		CPUShares:      opts.CPUShares,
+		CPUQuota:       opts.CPUQuota,
+		CPUPeriod:      opts.CPUPeriod,
+		CPUSetCPUs:     opts.CPUSetCPUs,
+		Ulimits:        opts.Ulimits,
+		NetworkMode:    opts.NetworkMode,
+		DNS:            opts.DNS,
+		ExtraHosts:     opts.ExtraHosts,
+		PortBindings:   opts.PortBindings,
+		GroupAdd:       opts.GroupAdd,
+		ReadonlyRootfs: opts.ReadOnlyRootfs,
+		Tmpfs:          opts.Tmpfs,
+		CapAdd:         opts.CapAdd,
+		CapDrop:        opts.CapDrop,
+		SecurityOpt:    opts.SecurityOpt,
+	}
+	if opts.PidsLimit > 0 {
+		pidsLimit := opts.PidsLimit
+		config.PidsLimit = &pidsLimit
+	}
+	return config
+}
+
+// FnCreateNetwork creates an internal network, containers attached to it
+// can not reach other containers or the outside world. The network is
+// labeled like the containers, with NetworkLabels
+func FnCreateNetwork(ctx context.Context, client *docker.Client) (network *docker.Network, err error) {
+	var uid uuid.UUID
+	uid, err = uuid.NewV4()
+	if err != nil {
+		return
+	}
+	network, err = client.CreateNetwork(docker.CreateNetworkOptions{
+		Name:           fmt.Sprintf("gofn-%s", uid.String()),
+		Driver:         "bridge",
+		Internal:       true,
+		CheckDuplicate: true,
+		Labels:         NetworkLabels(),
+		Context:        ctx,
+	})
+	return
+}
+
+// FnListNetworks lists the networks created by gofn
+func FnListNetworks(client *docker.Client) ([]docker.Network, error) {
+	return listNetworks(context.Background(), client)
+}
+
+func listNetworks(ctx context.Context, client *docker.Client) (networks []docker.Network, err error) {
+	err = withContext(ctx, func() (listErr error) {
+		networks, listErr = client.FilteredListNetworks(docker.NetworkFilterOpts{
+			"label": {LabelVersion: true},
+		})
+		return
+	})
+	return
+}
+
+// FnRemoveNetwork remove network
+func FnRemoveNetwork(client *docker.Client, networkID string) error {
+	return removeNetwork(context.Background(), client, networkID)
+}
+
+func removeNetwork(ctx context.Context, client *docker.Client, networkID string) error {
+	return withContext(ctx, func() error {
+		return client.RemoveNetwork(networkID)
+	})
+}
+
+// withContext runs call, which the client can not cancel, and returns
+// ctx.Err() once ctx is done without waiting for call to end
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return call()
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- call()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // FnImageBuild builds an image
-func FnImageBuild(client *docker.Client, opts *BuildOptions) (Name string, Stdout *bytes.Buffer, err error) {
+func FnImageBuild(ctx context.Context, client *docker.Client, opts *BuildOptions) (Name string, Stdout *bytes.Buffer, err error) {
 	if opts.Dockerfile == "" {
 		opts.Dockerfile = "Dockerfile"
 	}
@@ -100,10 +325,11 @@ func FnImageBuild(client *docker.Client, opts *BuildOptions) (Name string, Stdou
 	stdout := new(bytes.Buffer)
 	Name = opts.GetImageName()
 	if opts.ForcePull {
-		err = FnPull(client, opts)
+		err = FnPull(ctx, client, opts)
 		return
 	}
 	err = client.BuildImage(docker.BuildImageOptions{
+		Context:        ctx,
 		Name:           Name,
 		Dockerfile:     opts.Dockerfile,
 		SuppressOutput: true,
@@ -111,12 +337,13 @@ func FnImageBuild(client *docker.Client, opts *BuildOptions) (Name string, Stdou
 		ContextDir:     opts.ContextDir,
 		Remote:         opts.RemoteURI,
 		Auth:           opts.Auth,
+		Labels:         ImageLabels(opts),
 	})
 	if err != nil {
 		if !strings.Contains(err.Error(), "Cannot locate specified Dockerfile:") { // the error is not exported so we need to verify using the message
 			return
 		}
-		err = FnPull(client, opts)
+		err = FnPull(ctx, client, opts)
 		if err != nil {
 			return
 		}
@@ -141,9 +368,10 @@ func auth(client *docker.Client, opts *BuildOptions) (err error) {
 }
 
 // FnPull pull image from registry
-func FnPull(client *docker.Client, opts *BuildOptions) (err error) {
+func FnPull(ctx context.Context, client *docker.Client, opts *BuildOptions) (err error) {
 	repo, tag := parseDockerImage(opts.GetImageName())
 	err = client.PullImage(docker.PullImageOptions{
+		Context:    ctx,
 		Repository: repo,
 		Tag:        tag,
 	}, opts.Auth)
@@ -167,8 +395,12 @@ func parseDockerImage(image string) (repo, tag string) {
 
 // FnFindImage returns image data by name
 func FnFindImage(client *docker.Client, imageName string) (image docker.APIImages, err error) {
+	return findImage(context.Background(), client, imageName)
+}
+
+func findImage(ctx context.Context, client *docker.Client, imageName string) (image docker.APIImages, err error) {
 	var imgs []docker.APIImages
-	imgs, err = client.ListImages(docker.ListImagesOptions{Filter: imageName})
+	imgs, err = client.ListImages(docker.ListImagesOptions{Filter: imageName, Context: ctx})
 	if err != nil {
 		return
 	}
@@ -183,10 +415,14 @@ func FnFindImage(client *docker.Client, imageName string) (image docker.APIImage
 // FnFindContainerByID return container by ID
 func FnFindContainerByID(client *docker.Client, ID string) (container docker.APIContainers, err error) {
 	var containers []docker.APIContainers
-	containers, err = client.ListContainers(docker.ListContainersOptions{All: true})
+	containers, err = client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"id": {ID}},
+	})
 	if err != nil {
 		return
 	}
+	// the id filter also matches the IDs starting with ID
 	for _, v := range containers {
 		if v.ID == ID {
 			container = v
@@ -197,25 +433,33 @@ func FnFindContainerByID(client *docker.Client, ID string) (container docker.API
 	return
 }
 
-// FnFindContainer return container by image name
+// FnFindContainer return container by image name, found by its
+// LabelFunction. The name is also looked up with the gofn prefix of
+// BuildOptions.GetImageName when it has no prefix
 func FnFindContainer(client *docker.Client, imageName string) (container docker.APIContainers, err error) {
+	container, err = findContainer(client, imageName)
+	if err == ErrContainerNotFound && !strings.HasPrefix(imageName, "gofn/") {
+		container, err = findContainer(client, path.Join("gofn", imageName))
+	}
+	return
+}
+
+func findContainer(client *docker.Client, imageName string) (container docker.APIContainers, err error) {
 	var containers []docker.APIContainers
-	containers, err = client.ListContainers(docker.ListContainersOptions{All: true})
+	containers, err = client.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": {LabelFunction + "=" + imageName},
+		},
+	})
 	if err != nil {
 		return
 	}
-
-	if !strings.HasPrefix(imageName, "gofn") {
-		imageName = "gofn/" + imageName
-	}
-
-	for _, v := range containers {
-		if v.Image == imageName {
-			container = v
-			return
-		}
+	if len(containers) == 0 {
+		err = ErrContainerNotFound
+		return
 	}
-	err = ErrContainerNotFound
+	container = containers[0]
 	return
 }
 
@@ -225,9 +469,21 @@ func FnKillContainer(client *docker.Client, containerID string) (err error) {
 	return
 }
 
+// FnSignalContainer sends a signal to the container
+func FnSignalContainer(client *docker.Client, containerID string, signal docker.Signal) (err error) {
+	err = client.KillContainer(docker.KillContainerOptions{ID: containerID, Signal: signal})
+	return
+}
+
+// FnStopContainer sends SIGTERM to the container and kills it when it is
+// still running after the grace period
+func FnStopContainer(ctx context.Context, client *docker.Client, containerID string, grace time.Duration) error {
+	return StopContainer(ctx, NewDockerRuntime(client), containerID, grace)
+}
+
 //FnAttach attach into a running container
-func FnAttach(client *docker.Client, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (w docker.CloseWaiter, err error) {
-	return client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+func FnAttach(ctx context.Context, client *docker.Client, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (w docker.CloseWaiter, err error) {
+	w, err = client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
 		Container:    containerID,
 		RawTerminal:  true,
 		Stream:       true,
@@ -239,43 +495,83 @@ func FnAttach(client *docker.Client, containerID string, stdin io.Reader, stdout
 		ErrorStream:  stderr,
 		OutputStream: stdout,
 	})
+	if err != nil {
+		return
+	}
+	w = closeOnDone(ctx, w)
+	return
 }
 
-// FnStart start the container
-func FnStart(client *docker.Client, containerID string) error {
-	return client.StartContainer(containerID, nil)
+// attachment closes the attached connection when its context is done, the
+// attach options of the client do not take a context
+type attachment struct {
+	docker.CloseWaiter
+	done      chan struct{}
+	doneOnce  sync.Once
+	closeOnce sync.Once
+	closeErr  error
 }
 
-// FnRun runs the container
-func FnRun(client *docker.Client, containerID, input string) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
-	err = FnStart(client, containerID)
-	if err != nil {
-		return
+func closeOnDone(ctx context.Context, w docker.CloseWaiter) docker.CloseWaiter {
+	if ctx.Done() == nil {
+		return w
 	}
+	a := &attachment{CloseWaiter: w, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = a.Close()
+		case <-a.done:
+		}
+	}()
+	return a
+}
 
-	// attach to write input
-	_, err = FnAttach(client, containerID, strings.NewReader(input), nil, nil)
-	if err != nil {
-		return
-	}
+func (a *attachment) Wait() error {
+	err := a.CloseWaiter.Wait()
+	a.doneOnce.Do(func() { close(a.done) })
+	return err
+}
 
-	e := FnWaitContainer(client, containerID)
-	err = <-e
+// Close closes the connection once, the connection of the client can not
+// be closed twice
+func (a *attachment) Close() error {
+	a.doneOnce.Do(func() { close(a.done) })
+	a.closeOnce.Do(func() { a.closeErr = a.CloseWaiter.Close() })
+	return a.closeErr
+}
 
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
+// FnInspectContainer returns the low-level information of the container,
+// including its exit code and when it started and finished
+func FnInspectContainer(ctx context.Context, client *docker.Client, containerID string) (*docker.Container, error) {
+	return client.InspectContainerWithContext(containerID, ctx)
+}
 
-	// omit logs because execution error is more important
-	_ = FnLogs(client, containerID, stdout, stderr) // nolint
+// FnStart start the container
+func FnStart(client *docker.Client, containerID string) error {
+	return client.StartContainer(containerID, nil)
+}
 
+// FnRun runs the container, the run is aborted when ctx is done
+func FnRun(ctx context.Context, client *docker.Client, containerID string, opts ContainerOptions) (Stdout *bytes.Buffer, Stderr *bytes.Buffer, err error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	err = FnRunStream(ctx, client, containerID, opts, stdout, stderr)
 	Stdout = stdout
 	Stderr = stderr
 	return
 }
 
+// FnRunStream runs the container writing its output to stdout and stderr
+// while it is produced, see RunContainer
+func FnRunStream(ctx context.Context, client *docker.Client, containerID string, opts ContainerOptions, stdout io.Writer, stderr io.Writer) error {
+	return RunContainer(ctx, NewDockerRuntime(client), containerID, opts, stdout, stderr)
+}
+
 // FnLogs logs all container activity
-func FnLogs(client *docker.Client, containerID string, stdout io.Writer, stderr io.Writer) error {
+func FnLogs(ctx context.Context, client *docker.Client, containerID string, stdout io.Writer, stderr io.Writer) error {
 	return client.Logs(docker.LogsOptions{
+		Context:      ctx,
 		Container:    containerID,
 		Stdout:       true,
 		Stderr:       true,
@@ -284,36 +580,25 @@ func FnLogs(client *docker.Client, containerID string, stdout io.Writer, stderr
 	})
 }
 
-// FnWaitContainer wait until container finnish your processing
-func FnWaitContainer(client *docker.Client, containerID string) chan error {
-	errs := make(chan error)
-	go func() {
-		code, err := client.WaitContainer(containerID)
-		if err != nil {
-			errs <- err
-		}
-		if code != 0 {
-			errs <- ErrContainerExecutionFailed
-		}
-		errs <- nil
-	}()
-	return errs
+// FnWaitContainer wait until container finnish your processing or ctx is done,
+// see WaitContainer
+func FnWaitContainer(ctx context.Context, client *docker.Client, containerID string) chan error {
+	return WaitContainer(ctx, NewDockerRuntime(client), containerID)
 }
 
-// FnListContainers lists all the containers created by the gofn.
+// FnListContainers lists all the containers created by the gofn, found by
+// their LabelVersion.
 // It returns the APIContainers from the API, but have to be formatted for pretty printing
 func FnListContainers(client *docker.Client) (containers []docker.APIContainers, err error) {
-	hostContainers, err := client.ListContainers(docker.ListContainersOptions{
+	return listContainers(context.Background(), client)
+}
+
+func listContainers(ctx context.Context, client *docker.Client) (containers []docker.APIContainers, err error) {
+	return client.ListContainers(docker.ListContainersOptions{
 		All: true,
+		Filters: map[string][]string{
+			"label": {LabelVersion},
+		},
+		Context: ctx,
 	})
-	if err != nil {
-		containers = nil
-		return
-	}
-	for _, container := range hostContainers {
-		if strings.HasPrefix(container.Image, "gofn/") {
-			containers = append(containers, container)
-		}
-	}
-	return
 }
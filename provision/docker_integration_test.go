@@ -1,6 +1,7 @@
 package provision
 
 import (
+	"context"
 	"os"
 	"strings"
 	"testing"
@@ -23,7 +24,7 @@ func TestFnImageBuildIntegration(t *testing.T) {
 			Password: os.Getenv("DOCKER_PASSWORD"),
 		},
 	}
-	name, _, err := FnImageBuild(client, opts)
+	name, _, err := FnImageBuild(context.Background(), client, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,7 +37,7 @@ func TestFnImageBuildIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	stdout, stderr, err := FnRun(client, c.ID, "test")
+	stdout, stderr, err := FnRun(context.Background(), client, c.ID, ContainerOptions{Stdin: strings.NewReader("test")})
 	if err != nil {
 		t.Fatal(err)
 	}
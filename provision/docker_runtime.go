@@ -0,0 +1,196 @@
+package provision
+
+import (
+	"context"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DockerRuntime is the Runtime backed by a Docker daemon
+type DockerRuntime struct {
+	Client *docker.Client
+}
+
+// NewDockerRuntime creates a Runtime using the Docker client
+func NewDockerRuntime(client *docker.Client) *DockerRuntime {
+	return &DockerRuntime{Client: client}
+}
+
+// BuildImage builds the image or pulls it when opts.ForcePull is set or
+// the context has no Dockerfile
+func (r *DockerRuntime) BuildImage(ctx context.Context, opts *BuildOptions) (string, error) {
+	name, _, err := FnImageBuild(ctx, r.Client, opts)
+	return name, err
+}
+
+// PullImage pulls the image from its registry
+func (r *DockerRuntime) PullImage(ctx context.Context, opts *BuildOptions) error {
+	return FnPull(ctx, r.Client, opts)
+}
+
+// FindImage returns ErrImageNotFound when the image does not exist
+func (r *DockerRuntime) FindImage(ctx context.Context, name string) (Image, error) {
+	img, err := findImage(ctx, r.Client, name)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{ID: img.ID, Name: name}, nil
+}
+
+// CreateContainer creates the container without starting it
+func (r *DockerRuntime) CreateContainer(ctx context.Context, opts ContainerOptions) (*Container, error) {
+	container, err := createContainer(ctx, r.Client, opts)
+	if err != nil {
+		return nil, err
+	}
+	c := dockerContainer(container)
+	if c.Image == "" {
+		c.Image = opts.Image
+	}
+	return c, nil
+}
+
+// StartContainer starts the container
+func (r *DockerRuntime) StartContainer(ctx context.Context, containerID string) error {
+	return r.Client.StartContainerWithContext(containerID, nil, ctx)
+}
+
+// AttachContainer attaches the streams to the container, the output is
+// demultiplexed into stdout and stderr
+func (r *DockerRuntime) AttachContainer(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (CloseWaiter, error) {
+	w, err := r.Client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+		Container:    containerID,
+		Stream:       true,
+		Stdin:        stdin != nil,
+		Stdout:       stdout != nil,
+		Stderr:       stderr != nil,
+		InputStream:  stdin,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return closeOnDone(ctx, w), nil
+}
+
+// WaitContainer waits the container to exit and returns its exit code
+func (r *DockerRuntime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	return r.Client.WaitContainerWithContext(containerID, ctx)
+}
+
+// InspectContainer returns ErrContainerNotFound when the container does not exist
+func (r *DockerRuntime) InspectContainer(ctx context.Context, containerID string) (*Container, error) {
+	container, err := FnInspectContainer(ctx, r.Client, containerID)
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			err = ErrContainerNotFound
+		}
+		return nil, err
+	}
+	return dockerContainer(container), nil
+}
+
+// Logs writes all the output of the container
+func (r *DockerRuntime) Logs(ctx context.Context, containerID string, stdout io.Writer, stderr io.Writer) error {
+	return FnLogs(ctx, r.Client, containerID, stdout, stderr)
+}
+
+// KillContainer sends the signal to the container
+func (r *DockerRuntime) KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error {
+	return r.Client.KillContainer(docker.KillContainerOptions{
+		ID:      containerID,
+		Signal:  docker.Signal(signal),
+		Context: ctx,
+	})
+}
+
+// RemoveContainer removes the container even if it is running
+func (r *DockerRuntime) RemoveContainer(ctx context.Context, containerID string) error {
+	err := r.Client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:      containerID,
+		Force:   true,
+		Context: ctx,
+	})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		err = ErrContainerNotFound
+	}
+	return err
+}
+
+// ListContainers lists the containers created by gofn
+func (r *DockerRuntime) ListContainers(ctx context.Context) ([]Container, error) {
+	apiContainers, err := listContainers(ctx, r.Client)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]Container, 0, len(apiContainers))
+	for _, c := range apiContainers {
+		container := Container{
+			ID:      c.ID,
+			Image:   c.Image,
+			Created: time.Unix(c.Created, 0),
+			State:   ContainerState{Running: c.State == "running"},
+			Labels:  c.Labels,
+		}
+		if len(c.Names) > 0 {
+			container.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// CreateNetwork creates an internal network and returns its name
+func (r *DockerRuntime) CreateNetwork(ctx context.Context) (string, error) {
+	network, err := FnCreateNetwork(ctx, r.Client)
+	if err != nil {
+		return "", err
+	}
+	return network.Name, nil
+}
+
+// ListNetworks returns the networks created by gofn
+func (r *DockerRuntime) ListNetworks(ctx context.Context) ([]Network, error) {
+	networks, err := listNetworks(ctx, r.Client)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Network, 0, len(networks))
+	for _, n := range networks {
+		network := Network{Name: n.Name, Labels: n.Labels}
+		network.Created, _ = time.Parse(time.RFC3339, n.Labels[LabelCreated])
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// RemoveNetwork removes the network
+func (r *DockerRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	return removeNetwork(ctx, r.Client, name)
+}
+
+func dockerContainer(container *docker.Container) *Container {
+	c := &Container{
+		ID:      container.ID,
+		Name:    strings.TrimPrefix(container.Name, "/"),
+		ImageID: container.Image,
+		Created: container.Created,
+		State: ContainerState{
+			Running:    container.State.Running,
+			ExitCode:   container.State.ExitCode,
+			OOMKilled:  container.State.OOMKilled,
+			StartedAt:  container.State.StartedAt,
+			FinishedAt: container.State.FinishedAt,
+		},
+	}
+	if container.Config != nil {
+		c.Image = container.Config.Image
+		c.Labels = container.Config.Labels
+	}
+	return c
+}
@@ -0,0 +1,192 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the Docker implementation must provide the optional interfaces
+var _ NetworkRuntime = &DockerRuntime{}
+
+func TestDockerRuntimeCreateAndInspectContainer(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+	rt := NewDockerRuntime(client)
+	ctx := context.Background()
+
+	image := createFakeImage(client)
+	container, err := rt.CreateContainer(ctx, ContainerOptions{Image: image})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if container.ID == "" || container.Image != image {
+		t.Errorf("expected a container of %q but found %+v", image, container)
+	}
+
+	err = rt.StartContainer(ctx, container.ID)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	info, err := rt.InspectContainer(ctx, container.ID)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !info.State.Running {
+		t.Errorf("expected container %q to be running", container.ID)
+	}
+
+	containers, err := rt.ListContainers(ctx)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(containers) != 1 || containers[0].ID != container.ID {
+		t.Errorf("expected only container %q but found %+v", container.ID, containers)
+	}
+
+	err = rt.RemoveContainer(ctx, container.ID)
+	if err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	_, err = rt.InspectContainer(ctx, container.ID)
+	if err != ErrContainerNotFound {
+		t.Errorf("Expected %q but found %q", ErrContainerNotFound, err)
+	}
+	err = rt.RemoveContainer(ctx, container.ID)
+	if err != ErrContainerNotFound {
+		t.Errorf("Expected %q but found %q", ErrContainerNotFound, err)
+	}
+}
+
+func TestDockerRuntimeFindImage(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+	rt := NewDockerRuntime(client)
+
+	_, err := rt.FindImage(context.Background(), "gofn/python")
+	if err != ErrImageNotFound {
+		t.Errorf("Expected %q but found %q", ErrImageNotFound, err)
+	}
+	image := createFakeImage(client)
+	img, err := rt.FindImage(context.Background(), image)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if img.ID == "" || img.Name != image {
+		t.Errorf("expected image %q but found %+v", image, img)
+	}
+}
+
+func TestStopContainer(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+	rt := NewDockerRuntime(client)
+
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	err := StopContainer(context.Background(), rt, container.ID, 0)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	info, err := rt.InspectContainer(context.Background(), container.ID)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if info.State.Running {
+		t.Errorf("expected container %q to be stopped", container.ID)
+	}
+}
+
+// exitingRuntime is a container which exits on its own just before it is
+// sent SIGTERM, so the kill fails
+type exitingRuntime struct {
+	Runtime
+	exit chan struct{}
+}
+
+func (r *exitingRuntime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	<-r.exit
+	return 3, nil
+}
+
+func (r *exitingRuntime) KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error {
+	close(r.exit)
+	return errors.New("container " + containerID + " is not running")
+}
+
+func (r *exitingRuntime) InspectContainer(ctx context.Context, containerID string) (*Container, error) {
+	return &Container{ID: containerID, State: ContainerState{ExitCode: 3}}, nil
+}
+
+func TestWaitContainerExitedOnTimeout(t *testing.T) {
+	rt := &exitingRuntime{exit: make(chan struct{})}
+	err := waitContainer(context.Background(), rt, "exiting", time.Millisecond, time.Second)
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Code != 3 {
+		t.Errorf("expected the exit status of the container but found %q", err)
+	}
+}
+
+func TestDockerRuntimeDeadline(t *testing.T) {
+	// the server accepts the requests and never answers
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stalled:
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	rt := NewDockerRuntime(NewTestClient(server.URL, t))
+	calls := map[string]func(ctx context.Context) error{
+		"FindImage": func(ctx context.Context) error {
+			_, err := rt.FindImage(ctx, "gofn/python")
+			return err
+		},
+		"ListContainers": func(ctx context.Context) error {
+			_, err := rt.ListContainers(ctx)
+			return err
+		},
+		"ListNetworks": func(ctx context.Context) error {
+			_, err := rt.ListNetworks(ctx)
+			return err
+		},
+		"RemoveNetwork": func(ctx context.Context) error {
+			return rt.RemoveNetwork(ctx, "gofn-network")
+		},
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- call(ctx)
+		}()
+		select {
+		case err := <-errs:
+			if err != context.DeadlineExceeded {
+				t.Errorf("%v: Expected %q but %q found", name, context.DeadlineExceeded, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v: expected the deadline to be honored by a stalled host", name)
+		}
+		cancel()
+	}
+}
@@ -1,8 +1,10 @@
 package provision
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	fake "github.com/fsouza/go-dockerclient/testing"
@@ -30,6 +32,7 @@ func createFakeContainer(client *docker.Client, t *testing.T) *docker.Container
 			Image:     image,
 			StdinOnce: true,
 			OpenStdin: true,
+			Labels:    ContainerLabels(ContainerOptions{Image: image}, "123"),
 		},
 	})
 	if err != nil {
@@ -175,7 +178,7 @@ func TestFnBuildImageSuccessfully(t *testing.T) {
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", false, "test", "", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(context.Background(), client, &BuildOptions{"./testing_data", "", false, "test", "", "", nil, docker.AuthConfiguration{}, false, nil, ""})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -192,7 +195,7 @@ func TestFnBuildImageRemoteSuccessfully(t *testing.T) {
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", false, "test", "https://github.com/gofn/dockerfile-python-exampl://github.com/gofn/dockerfile-python-example.git", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(context.Background(), client, &BuildOptions{"./testing_data", "", false, "test", "https://github.com/gofn/dockerfile-python-exampl://github.com/gofn/dockerfile-python-example.git", "", nil, docker.AuthConfiguration{}, false, nil, ""})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -210,7 +213,7 @@ func TestFnBuildImageDoNotUsePrefixImageName(t *testing.T) {
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
 	imageName := "testDoNotUsePrefixImageName"
-	name, _, err := FnImageBuild(client, &BuildOptions{"./testing_data", "", true, imageName, "", "", nil, docker.AuthConfiguration{}, false})
+	name, _, err := FnImageBuild(context.Background(), client, &BuildOptions{"./testing_data", "", true, imageName, "", "", nil, docker.AuthConfiguration{}, false, nil, ""})
 	if err != nil {
 		t.Errorf("FnImageBuild expected nil but found %q, %q", name, err)
 	}
@@ -225,7 +228,7 @@ func TestFnBuildImageDockerfileNotFound(t *testing.T) {
 
 	// Instantiate a client
 	client := NewTestClient(server.URL(), t)
-	_, _, err := FnImageBuild(client, &BuildOptions{"./wrong", "Dockerfile", false, "test", "", "", nil, docker.AuthConfiguration{}, false})
+	_, _, err := FnImageBuild(context.Background(), client, &BuildOptions{"./wrong", "Dockerfile", false, "test", "", "", nil, docker.AuthConfiguration{}, false, nil, ""})
 	if err == nil {
 		t.Errorf("FnImageBuild expected error but returned nil")
 	}
@@ -325,6 +328,64 @@ func TestFnListContainers(t *testing.T) {
 	}
 }
 
+func TestFnListContainersLabels(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	client := NewTestClient(server.URL(), t)
+	imageName := createFakeImage(client)
+	_ = client.PullImage(docker.PullImageOptions{Repository: "python"}, docker.AuthConfiguration{})
+	// a container with the gofn image which was not created by gofn
+	_, err := client.CreateContainer(docker.CreateContainerOptions{
+		Name:   "other",
+		Config: &docker.Config{Image: imageName},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := FnContainer(client, ContainerOptions{
+		Image:        "python",
+		InvocationID: "42",
+		Owner:        "service",
+		Labels:       map[string]string{"team": "fn", LabelVersion: "replaced"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	labels := container.Config.Labels
+	expected := map[string]string{
+		LabelVersion:    Version,
+		LabelFunction:   "python",
+		LabelInvocation: "42",
+		LabelOwner:      "service",
+		"team":          "fn",
+	}
+	for k, v := range expected {
+		if labels[k] != v {
+			t.Errorf("Expected %q but found %q in label %v", v, labels[k], k)
+		}
+	}
+	if _, err = time.Parse(time.RFC3339, labels[LabelCreated]); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+
+	containers, err := FnListContainers(client)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(containers) != 1 || containers[0].ID != container.ID {
+		t.Errorf("Expected only the container %v but found %v", container.ID, containers)
+	}
+	// DoNotUsePrefixImageName images are found without the prefix
+	found, err := FnFindContainer(client, "python")
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if found.ID != container.ID {
+		t.Errorf("Expected %q but found %q", container.ID, found.ID)
+	}
+}
+
 func TestFnFindContainerByIDServerError(t *testing.T) {
 	client := NewTestClient("wrong", t)
 
@@ -423,3 +484,248 @@ func TestFnKilContainerNotFound(t *testing.T) {
 		t.Errorf("expecting errors, but nothing found")
 	}
 }
+
+func TestFnWaitContainerCanceled(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	// Create and start a container that never exits
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := FnWaitContainer(ctx, client, container.ID)
+	cancel()
+	if e := <-errs; e == nil {
+		t.Errorf("expecting errors, but nothing found")
+	}
+}
+
+func TestFnInspectContainer(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	info, err := FnInspectContainer(context.Background(), client, container.ID)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !info.State.Running {
+		t.Errorf("expected container %q to be running", container.ID)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	var err error = &ExitError{Code: 2}
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("expected *ExitError but found %T", err)
+	}
+	if exitErr.Code != 2 {
+		t.Errorf("expected exit code 2 but found %d", exitErr.Code)
+	}
+	if !strings.Contains(err.Error(), "status 2") {
+		t.Errorf("expected exit status in message but found %q", err.Error())
+	}
+	if !exitErr.Is(ErrContainerExecutionFailed) {
+		t.Error("expected the exit error to match ErrContainerExecutionFailed")
+	}
+}
+
+func TestFnRunStreamCanceled(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	container := createFakeContainer(client, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e := FnRunStream(ctx, client, container.ID, ContainerOptions{}, nil, nil); e == nil {
+		t.Errorf("expecting errors, but nothing found")
+	}
+}
+
+func TestFnContainerCreatedWithResources(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	opts := ContainerOptions{
+		Image:      image,
+		Memory:     64 * 1024 * 1024,
+		MemorySwap: 64 * 1024 * 1024,
+		CPUShares:  512,
+		CPUQuota:   50000,
+		CPUPeriod:  100000,
+		CPUSetCPUs: "0",
+		PidsLimit:  32,
+		Ulimits:    []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 1024}},
+	}
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	hostConfig := container.HostConfig
+	if hostConfig.Memory != opts.Memory || hostConfig.MemorySwap != opts.MemorySwap {
+		t.Errorf("expected memory %d/%d but found %d/%d", opts.Memory, opts.MemorySwap, hostConfig.Memory, hostConfig.MemorySwap)
+	}
+	if hostConfig.CPUShares != opts.CPUShares || hostConfig.CPUQuota != opts.CPUQuota || hostConfig.CPUPeriod != opts.CPUPeriod {
+		t.Errorf("expected cpu %d/%d/%d but found %d/%d/%d", opts.CPUShares, opts.CPUQuota, opts.CPUPeriod, hostConfig.CPUShares, hostConfig.CPUQuota, hostConfig.CPUPeriod)
+	}
+	if hostConfig.CPUSetCPUs != opts.CPUSetCPUs {
+		t.Errorf("expected cpuset %q but found %q", opts.CPUSetCPUs, hostConfig.CPUSetCPUs)
+	}
+	if hostConfig.PidsLimit == nil || *hostConfig.PidsLimit != opts.PidsLimit {
+		t.Errorf("expected pids limit %d but found %v", opts.PidsLimit, hostConfig.PidsLimit)
+	}
+	if len(hostConfig.Ulimits) != 1 || hostConfig.Ulimits[0] != opts.Ulimits[0] {
+		t.Errorf("expected ulimits %v but found %v", opts.Ulimits, hostConfig.Ulimits)
+	}
+}
+
+func TestFnContainerCreatedWithNetwork(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+	image := createFakeImage(client)
+
+	port := docker.Port("8080/tcp")
+	opts := ContainerOptions{
+		Image:        image,
+		NetworkMode:  NetworkNone,
+		DNS:          []string{"8.8.8.8"},
+		ExtraHosts:   []string{"gofn:127.0.0.1"},
+		PortBindings: map[docker.Port][]docker.PortBinding{port: {{HostPort: "8080"}}},
+	}
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	hostConfig := container.HostConfig
+	if hostConfig.NetworkMode != NetworkNone {
+		t.Errorf("expected network mode %q but found %q", NetworkNone, hostConfig.NetworkMode)
+	}
+	if len(hostConfig.DNS) != 1 || hostConfig.DNS[0] != "8.8.8.8" {
+		t.Errorf("expected dns %v but found %v", opts.DNS, hostConfig.DNS)
+	}
+	if len(hostConfig.ExtraHosts) != 1 || hostConfig.ExtraHosts[0] != "gofn:127.0.0.1" {
+		t.Errorf("expected extra hosts %v but found %v", opts.ExtraHosts, hostConfig.ExtraHosts)
+	}
+	if len(hostConfig.PortBindings[port]) != 1 {
+		t.Errorf("expected port %q to be published but found %v", port, hostConfig.PortBindings)
+	}
+	if _, ok := container.Config.ExposedPorts[port]; !ok {
+		t.Errorf("expected port %q to be exposed but found %v", port, container.Config.ExposedPorts)
+	}
+}
+
+func TestFnCreateAndRemoveNetwork(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	network, err := FnCreateNetwork(context.Background(), client)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+
+	if !strings.HasPrefix(network.Name, "gofn-") {
+		t.Errorf("network should starts with gofn- but found %q", network.Name)
+	}
+	if e := FnRemoveNetwork(client, network.ID); e != nil {
+		t.Errorf("Expected no errors but %q found", e)
+	}
+}
+
+func TestFnContainerCreatedWithHardenedDefaults(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	opts := HardenedDefaults()
+	opts.Image = createFakeImage(client)
+	opts.CapAdd = []string{"NET_BIND_SERVICE"}
+	container, err := FnContainer(client, opts)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if container.Config.User != opts.User {
+		t.Errorf("expected user %q but found %q", opts.User, container.Config.User)
+	}
+	hostConfig := container.HostConfig
+	if !hostConfig.ReadonlyRootfs {
+		t.Error("expected a read only root filesystem")
+	}
+	if _, ok := hostConfig.Tmpfs["/tmp"]; !ok {
+		t.Errorf("expected /tmp to be a tmpfs but found %v", hostConfig.Tmpfs)
+	}
+	if len(hostConfig.CapDrop) != 1 || hostConfig.CapDrop[0] != "ALL" {
+		t.Errorf("expected all capabilities to be dropped but found %v", hostConfig.CapDrop)
+	}
+	if len(hostConfig.CapAdd) != 1 || hostConfig.CapAdd[0] != "NET_BIND_SERVICE" {
+		t.Errorf("expected capabilities %v but found %v", opts.CapAdd, hostConfig.CapAdd)
+	}
+	if len(hostConfig.SecurityOpt) != 1 || hostConfig.SecurityOpt[0] != "no-new-privileges" {
+		t.Errorf("expected security options %v but found %v", opts.SecurityOpt, hostConfig.SecurityOpt)
+	}
+}
+
+func TestFnStopContainer(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	container := createFakeContainer(client, t)
+	runFakeContainer(client, container.ID, t)
+
+	if e := FnStopContainer(context.Background(), client, container.ID, time.Second); e != nil {
+		t.Errorf("Expected no errors but %q found", e)
+	}
+}
+
+func TestFnRunStreamTimeout(t *testing.T) {
+
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+
+	// Instantiate a client
+	client := NewTestClient(server.URL(), t)
+
+	// the fake container runs until it is stopped
+	container := createFakeContainer(client, t)
+
+	opts := ContainerOptions{Timeout: 50 * time.Millisecond, StopTimeout: time.Second}
+	if e := FnRunStream(context.Background(), client, container.ID, opts, nil, nil); e != ErrTimeout {
+		t.Errorf("Expected %q but found %q", ErrTimeout, e)
+	}
+}
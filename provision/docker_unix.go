@@ -8,10 +8,13 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 )
 
+// defaultEndpoint is the address of the local docker daemon
+const defaultEndpoint = "unix:///var/run/docker.sock"
+
 // FnClient instantiate a docker client
 func FnClient(endPoint, certsDir string) (client *docker.Client, err error) {
 	if endPoint == "" {
-		endPoint = "unix:///var/run/docker.sock"
+		endPoint = defaultEndpoint
 	}
 	if certsDir != "" {
 		client, err = docker.NewTLSClient(endPoint, filepath.Join(certsDir, "cert.pem"), filepath.Join(certsDir, "key.pem"), filepath.Join(certsDir, "ca.pem"))
@@ -8,12 +8,15 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 )
 
+// defaultEndpoint is the address of the local docker daemon
+const defaultEndpoint = "npipe:////./pipe/docker_engine"
+
 // FnClient instantiate a docker client
 // For datails https://docs.docker.com/docker-for-windows/faqs/#can-i-use-docker-for-windows-with-new-swarm-mode
 // on section "How do I connect to the remote Docker Engine API?"
 func FnClient(endPoint, certsDir string) (client *docker.Client, err error) {
 	if endPoint == "" {
-		endPoint = "npipe:////./pipe/docker_engine"
+		endPoint = defaultEndpoint
 	}
 	if certsDir != "" {
 		client, err = docker.NewTLSClient(endPoint, filepath.Join(certsDir, "cert.pem"), filepath.Join(certsDir, "key.pem"), filepath.Join(certsDir, "ca.pem"))
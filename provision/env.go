@@ -0,0 +1,188 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DockerEndpoint is the address of a docker daemon and the TLS settings
+// used to connect to it
+type DockerEndpoint struct {
+	Host string
+	// TLS is used when it is true, CertsDir has the ca.pem, cert.pem and
+	// key.pem files. Without cert.pem and key.pem no client certificate
+	// is sent, and the server is verified with the system CAs without
+	// ca.pem unless SkipTLSVerify is set
+	TLS           bool
+	CertsDir      string
+	SkipTLSVerify bool
+	// Context is the name of the docker context, empty when the endpoint
+	// comes from DOCKER_HOST or is the default one
+	Context string
+}
+
+// contextMeta is the meta.json of a context in the docker context store
+type contextMeta struct {
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+}
+
+// EndpointFromEnv resolves the docker endpoint like the docker CLI does.
+// DOCKER_HOST is used when it is set, otherwise the context named by
+// DOCKER_CONTEXT or by the currentContext of the docker config file, and
+// the default socket when there is no context. DOCKER_TLS_VERIFY enables
+// TLS with the certificates in DOCKER_CERT_PATH, or in the docker config
+// directory, unless the endpoint comes from a context
+func EndpointFromEnv() (endpoint DockerEndpoint, err error) {
+	configDir := dockerConfigDir()
+	name := ""
+	if os.Getenv("DOCKER_HOST") == "" {
+		name, err = currentContext(configDir)
+		if err != nil {
+			return
+		}
+	}
+	if name != "" && name != "default" {
+		return contextEndpoint(configDir, name)
+	}
+
+	endpoint.Host = os.Getenv("DOCKER_HOST")
+	if endpoint.Host == "" {
+		endpoint.Host = defaultEndpoint
+	}
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		endpoint.TLS = true
+		endpoint.CertsDir = os.Getenv("DOCKER_CERT_PATH")
+		if endpoint.CertsDir == "" {
+			endpoint.CertsDir = configDir
+		}
+	}
+	return
+}
+
+// FnClientFromEnv instantiate a docker client for the endpoint returned by
+// EndpointFromEnv
+func FnClientFromEnv() (*docker.Client, error) {
+	endpoint, err := EndpointFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return endpoint.Client()
+}
+
+// Client instantiate a docker client connected to the endpoint, ssh://
+// hosts are reached with FnSSHClient
+func (e DockerEndpoint) Client() (*docker.Client, error) {
+	if strings.HasPrefix(e.Host, "ssh://") {
+		return FnSSHClient(e.Host, SSHOptions{})
+	}
+	if !e.TLS {
+		return docker.NewClient(e.Host)
+	}
+	var cert, key, ca string
+	if e.CertsDir != "" {
+		cert = filepath.Join(e.CertsDir, "cert.pem")
+		key = filepath.Join(e.CertsDir, "key.pem")
+		if !e.SkipTLSVerify {
+			ca = filepath.Join(e.CertsDir, "ca.pem")
+		}
+	}
+	client, err := docker.NewTLSClient(e.Host, cert, key, ca)
+	if err != nil {
+		return nil, err
+	}
+	// the client skips the verification when there is no CA, the system
+	// CAs are used instead like the docker CLI does
+	client.TLSConfig.InsecureSkipVerify = e.SkipTLSVerify
+	return client, nil
+}
+
+// dockerConfigDir returns DOCKER_CONFIG or the .docker directory in the
+// home of the user
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(homeDir(), ".docker")
+}
+
+func homeDir() string {
+	if runtime.GOOS == "windows" {
+		return os.Getenv("USERPROFILE")
+	}
+	return os.Getenv("HOME")
+}
+
+// currentContext returns DOCKER_CONTEXT or the currentContext of the
+// config.json, empty when none is set
+func currentContext(configDir string) (string, error) {
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return "", fmt.Errorf("provision: invalid docker config: %v", err)
+	}
+	return config.CurrentContext, nil
+}
+
+// contextEndpoint reads the docker endpoint of the context from the context
+// store, the metadata and the TLS files of each context are kept in
+// directories named after the SHA-256 of the name of the context
+func contextEndpoint(configDir, name string) (endpoint DockerEndpoint, err error) {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+	b, err := ioutil.ReadFile(filepath.Join(configDir, "contexts", "meta", id, "meta.json"))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("provision: docker context %q not found", name)
+		return
+	}
+	if err != nil {
+		return
+	}
+	var meta contextMeta
+	err = json.Unmarshal(b, &meta)
+	if err != nil {
+		err = fmt.Errorf("provision: invalid docker context %q: %v", name, err)
+		return
+	}
+	e, ok := meta.Endpoints["docker"]
+	if !ok || e.Host == "" {
+		err = fmt.Errorf("provision: docker context %q has no docker endpoint", name)
+		return
+	}
+	endpoint.Host = e.Host
+	endpoint.Context = name
+	endpoint.SkipTLSVerify = e.SkipTLSVerify
+	endpoint.TLS = e.SkipTLSVerify
+	certsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if _, err = os.Stat(certsDir); err == nil {
+		endpoint.TLS = true
+		endpoint.CertsDir = certsDir
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	return
+}
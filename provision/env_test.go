@@ -0,0 +1,165 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setenv(t *testing.T, key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if ok {
+			_ = os.Setenv(key, old)
+			return
+		}
+		_ = os.Unsetenv(key)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeContext adds a context to the docker context store in dir and
+// returns the directory of its TLS files
+func writeContext(t *testing.T, dir, name, meta string, tls bool) string {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+	writeFile(t, filepath.Join(dir, "contexts", "meta", id, "meta.json"), meta)
+	certsDir := filepath.Join(dir, "contexts", "tls", id, "docker")
+	if tls {
+		writeFile(t, filepath.Join(certsDir, "ca.pem"), "")
+	}
+	return certsDir
+}
+
+func TestEndpointFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certsDir := writeContext(t, dir, "remote", `{"Name":"remote","Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376","SkipTLSVerify":false}}}`, true)
+	writeContext(t, dir, "insecure", `{"Name":"insecure","Endpoints":{"docker":{"Host":"tcp://10.0.0.2:2376","SkipTLSVerify":true}}}`, false)
+
+	var tt = []struct {
+		name     string
+		env      map[string]string
+		endpoint DockerEndpoint
+	}{
+		{"default", nil, DockerEndpoint{Host: defaultEndpoint}},
+		{
+			"docker host",
+			map[string]string{"DOCKER_HOST": "tcp://127.0.0.1:2375"},
+			DockerEndpoint{Host: "tcp://127.0.0.1:2375"},
+		},
+		{
+			"tls verify",
+			map[string]string{"DOCKER_HOST": "tcp://127.0.0.1:2376", "DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": "/certs"},
+			DockerEndpoint{Host: "tcp://127.0.0.1:2376", TLS: true, CertsDir: "/certs"},
+		},
+		{
+			"tls verify default cert path",
+			map[string]string{"DOCKER_HOST": "tcp://127.0.0.1:2376", "DOCKER_TLS_VERIFY": "1"},
+			DockerEndpoint{Host: "tcp://127.0.0.1:2376", TLS: true, CertsDir: dir},
+		},
+		{
+			"docker context",
+			map[string]string{"DOCKER_CONTEXT": "remote"},
+			DockerEndpoint{Host: "tcp://10.0.0.1:2376", TLS: true, CertsDir: certsDir, Context: "remote"},
+		},
+		{
+			"skip tls verify",
+			map[string]string{"DOCKER_CONTEXT": "insecure"},
+			DockerEndpoint{Host: "tcp://10.0.0.2:2376", TLS: true, SkipTLSVerify: true, Context: "insecure"},
+		},
+		{
+			"default context",
+			map[string]string{"DOCKER_CONTEXT": "default"},
+			DockerEndpoint{Host: defaultEndpoint},
+		},
+		{
+			"docker host overrides context",
+			map[string]string{"DOCKER_CONTEXT": "remote", "DOCKER_HOST": "tcp://127.0.0.1:2375"},
+			DockerEndpoint{Host: "tcp://127.0.0.1:2375"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setenv(t, "DOCKER_CONFIG", dir)()
+			for _, key := range []string{"DOCKER_HOST", "DOCKER_CONTEXT", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"} {
+				defer setenv(t, key, tc.env[key])()
+			}
+			endpoint, err := EndpointFromEnv()
+			if err != nil {
+				t.Fatalf("Expected no errors but %q found", err)
+			}
+			if endpoint != tc.endpoint {
+				t.Errorf("expected %+v but found %+v", tc.endpoint, endpoint)
+			}
+		})
+	}
+}
+
+func TestEndpointFromEnvCurrentContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv(t, "DOCKER_CONFIG", dir)()
+	defer setenv(t, "DOCKER_HOST", "")()
+	defer setenv(t, "DOCKER_CONTEXT", "")()
+	writeContext(t, dir, "plain", `{"Name":"plain","Endpoints":{"docker":{"Host":"unix:///tmp/docker.sock"}}}`, false)
+	writeFile(t, filepath.Join(dir, "config.json"), `{"auths":{},"currentContext":"plain"}`)
+
+	endpoint, err := EndpointFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if endpoint.Host != "unix:///tmp/docker.sock" || endpoint.Context != "plain" || endpoint.TLS {
+		t.Errorf("expected the endpoint of the current context but found %+v", endpoint)
+	}
+
+	defer setenv(t, "DOCKER_CONTEXT", "missing")()
+	if _, err = EndpointFromEnv(); err == nil {
+		t.Error("expecting errors for a missing context, but nothing found")
+	}
+}
+
+func TestDockerEndpointClientVerifiesTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without ca.pem the server is verified with the system CAs
+	client, err := DockerEndpoint{Host: "tcp://127.0.0.1:2376", TLS: true, CertsDir: dir}.Client()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if client.TLSConfig.InsecureSkipVerify {
+		t.Error("expected the server to be verified without ca.pem")
+	}
+
+	client, err = DockerEndpoint{Host: "tcp://127.0.0.1:2376", TLS: true, CertsDir: dir, SkipTLSVerify: true}.Client()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if !client.TLSConfig.InsecureSkipVerify {
+		t.Error("expected the verification to be skipped with SkipTLSVerify")
+	}
+}
@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"context"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Attacher streams stdin to a container of a running pod
+type Attacher interface {
+	Attach(ctx context.Context, namespace, pod, container string, stdin io.Reader) error
+}
+
+// SPDYAttacher attaches to pods through the attach subresource of the API,
+// like kubectl attach
+type SPDYAttacher struct {
+	Client kubernetes.Interface
+	Config *rest.Config
+}
+
+// Attach streams stdin until EOF, the container sees the end of its input
+// when the stream is closed
+func (a *SPDYAttacher) Attach(ctx context.Context, namespace, pod, container string, stdin io.Reader) error {
+	req := a.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: container,
+			Stdin:     true,
+		}, scheme.ParameterCodec)
+	exec, err := remotecommand.NewSPDYExecutor(a.Config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin})
+}
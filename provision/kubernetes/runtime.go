@@ -0,0 +1,561 @@
+// Package kubernetes runs gofn functions as Kubernetes Jobs. Each container
+// is a Job with a single pod that is never restarted, the input is streamed
+// by attaching to the pod and the output is read from its logs.
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+	"github.com/gofrs/uuid"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// containerName is the name of the container in the pod of every Job
+	containerName = "fn"
+
+	// ContainerLabel holds the ID of the container in the Job and its pod
+	ContainerLabel = "gofn/container"
+	// ManagedByLabel marks the Jobs created by gofn
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+
+	defaultPollInterval = time.Second
+)
+
+// ErrNotStarted is raised when the Job of the container was not created yet
+var ErrNotStarted = errors.New("kubernetes: container not started")
+
+// Runtime is the provision.Runtime backed by a Kubernetes cluster. Images
+// are pulled by the nodes and can not be built. The logs of a pod mix
+// stdout and stderr, so all the output is written to stdout
+type Runtime struct {
+	Client    kubernetes.Interface
+	Namespace string
+	// Attacher streams stdin to the pods, the containers have no stdin when
+	// it is nil
+	Attacher Attacher
+	// PollInterval is how often the pods are checked while waiting
+	PollInterval time.Duration
+
+	mu         sync.Mutex
+	containers map[string]*container
+}
+
+var _ provision.Runtime = &Runtime{}
+
+// container is a container created by this runtime, the Job is only
+// submitted when the container starts so the streams can be attached first
+type container struct {
+	job     *batchv1.Job
+	created time.Time
+	started bool
+	attach  *attachment
+	// killed is the signal the pod was deleted with
+	killed syscall.Signal
+}
+
+// New creates a Runtime for the namespace, the "default" namespace is used
+// when it is empty. Stdin is streamed when config is not nil
+func New(client kubernetes.Interface, config *rest.Config, namespace string) *Runtime {
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	r := &Runtime{
+		Client:       client,
+		Namespace:    namespace,
+		PollInterval: defaultPollInterval,
+		containers:   make(map[string]*container),
+	}
+	if config != nil {
+		r.Attacher = &SPDYAttacher{Client: client, Config: config}
+	}
+	return r
+}
+
+// NewFromKubeconfig creates a Runtime using the kubeconfig file, KUBECONFIG
+// or ~/.kube/config is used when path is empty and the in cluster
+// configuration when none exists
+func NewFromKubeconfig(path, namespace string) (*Runtime, error) {
+	if path == "" {
+		path = os.Getenv("KUBECONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(clientcmd.RecommendedHomeFile); err == nil {
+			path = clientcmd.RecommendedHomeFile
+		}
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return New(client, config, namespace), nil
+}
+
+// BuildImage returns the name of the image to be pulled by the nodes when
+// opts.ForcePull is set or the context has no Dockerfile, images can not be
+// built so ErrNotSupported is returned otherwise
+func (r *Runtime) BuildImage(ctx context.Context, opts *provision.BuildOptions) (string, error) {
+	if !opts.ForcePull {
+		if opts.RemoteURI != "" {
+			return "", provision.ErrNotSupported
+		}
+		dockerfile := opts.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		contextDir := opts.ContextDir
+		if contextDir == "" {
+			contextDir = "./"
+		}
+		if _, err := os.Stat(filepath.Join(contextDir, dockerfile)); err == nil {
+			return "", provision.ErrNotSupported
+		}
+	}
+	return opts.GetImageName(), nil
+}
+
+// PullImage does nothing, the image is pulled by the node running the pod
+func (r *Runtime) PullImage(ctx context.Context, opts *provision.BuildOptions) error {
+	return nil
+}
+
+// FindImage always returns provision.ErrImageNotFound, the images of the
+// nodes are not known until a pod runs
+func (r *Runtime) FindImage(ctx context.Context, name string) (provision.Image, error) {
+	return provision.Image{}, provision.ErrImageNotFound
+}
+
+// CreateContainer translates opts into the spec of a Job, which is
+// submitted when the container is started
+func (r *Runtime) CreateContainer(ctx context.Context, opts provision.ContainerOptions) (*provision.Container, error) {
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("gofn-%s", uid.String())
+	podSpec, err := podSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+	if r.Attacher != nil {
+		podSpec.Containers[0].Stdin = true
+		podSpec.Containers[0].StdinOnce = true
+	}
+	labels := map[string]string{
+		ContainerLabel: id,
+		ManagedByLabel: "gofn",
+	}
+	// the values of the gofn labels are not valid label values, they are
+	// kept as annotations
+	annotations := provision.ContainerLabels(opts, uid.String())
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        id,
+			Namespace:   r.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       podSpec,
+			},
+		},
+	}
+	c := &container{job: job, created: time.Now()}
+	r.mu.Lock()
+	r.containers[id] = c
+	r.mu.Unlock()
+	return &provision.Container{
+		ID:      id,
+		Name:    id,
+		Image:   opts.Image,
+		Created: c.created,
+		Labels:  annotations,
+	}, nil
+}
+
+// StartContainer submits the Job, the attached streams are connected once
+// its pod runs
+func (r *Runtime) StartContainer(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	c, ok := r.containers[containerID]
+	if !ok {
+		r.mu.Unlock()
+		return provision.ErrContainerNotFound
+	}
+	if c.started {
+		r.mu.Unlock()
+		return fmt.Errorf("kubernetes: container %v already started", containerID)
+	}
+	c.started = true
+	a := c.attach
+	r.mu.Unlock()
+
+	_, err := r.Client.BatchV1().Jobs(r.Namespace).Create(ctx, c.job, metav1.CreateOptions{})
+	if err != nil {
+		r.mu.Lock()
+		c.started = false
+		r.mu.Unlock()
+		return err
+	}
+	if a != nil {
+		a.mu.Lock()
+		a.streaming = true
+		a.mu.Unlock()
+		go r.stream(containerID, a)
+	}
+	return nil
+}
+
+// AttachContainer attaches the streams to a container not started yet,
+// stdout receives both the stdout and stderr of the container
+func (r *Runtime) AttachContainer(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (provision.CloseWaiter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.containers[containerID]
+	if !ok {
+		return nil, provision.ErrContainerNotFound
+	}
+	if c.started {
+		return nil, provision.ErrNotSupported
+	}
+	a := &attachment{
+		stdin:  stdin,
+		stdout: stdout,
+		done:   make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	c.attach = a
+	return a, nil
+}
+
+// WaitContainer waits the container of the pod to terminate and returns
+// its exit code, a pod deleted by KillContainer exits with 128 plus the
+// signal like a killed process
+func (r *Runtime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	ticker := time.NewTicker(r.pollInterval())
+	defer ticker.Stop()
+	for {
+		pod, err := r.pod(ctx, containerID)
+		if err != nil {
+			return 0, err
+		}
+		if pod != nil {
+			status := containerStatus(pod)
+			if status != nil && status.State.Terminated != nil {
+				return int(status.State.Terminated.ExitCode), nil
+			}
+			if err = waitingError(status); err != nil {
+				return 0, err
+			}
+		} else if signal := r.killed(containerID); signal != 0 {
+			return 128 + int(signal), nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// InspectContainer returns provision.ErrContainerNotFound when neither the
+// container nor its Job exist
+func (r *Runtime) InspectContainer(ctx context.Context, containerID string) (*provision.Container, error) {
+	job, err := r.job(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	info := jobContainer(job)
+	pod, err := r.pod(ctx, containerID)
+	if err != nil && err != ErrNotStarted {
+		return nil, err
+	}
+	if pod != nil {
+		podState(pod, &info.State)
+	} else if signal := r.killed(containerID); signal != 0 {
+		info.State.ExitCode = 128 + int(signal)
+	}
+	return &info, nil
+}
+
+// Logs writes the logs of the pod to stdout
+func (r *Runtime) Logs(ctx context.Context, containerID string, stdout io.Writer, stderr io.Writer) error {
+	pod, err := r.pod(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	if pod == nil {
+		return nil
+	}
+	return r.copyLogs(ctx, pod.Name, false, stdout)
+}
+
+// KillContainer deletes the pod of the container, it is given the
+// termination grace period of the pod to exit unless signal is SIGKILL.
+// The Job is deleted when its pod was not created yet
+func (r *Runtime) KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error {
+	pod, err := r.pod(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	opts := metav1.DeleteOptions{}
+	if signal == syscall.SIGKILL {
+		grace := int64(0)
+		opts.GracePeriodSeconds = &grace
+	}
+	if pod != nil {
+		err = r.Client.CoreV1().Pods(r.Namespace).Delete(ctx, pod.Name, opts)
+	} else {
+		propagation := metav1.DeletePropagationBackground
+		opts.PropagationPolicy = &propagation
+		err = r.Client.BatchV1().Jobs(r.Namespace).Delete(ctx, containerID, opts)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	r.mu.Lock()
+	if c, ok := r.containers[containerID]; ok && (c.killed == 0 || signal == syscall.SIGKILL) {
+		c.killed = signal
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// RemoveContainer deletes the Job and its pod
+func (r *Runtime) RemoveContainer(ctx context.Context, containerID string) error {
+	r.mu.Lock()
+	c, known := r.containers[containerID]
+	delete(r.containers, containerID)
+	r.mu.Unlock()
+	if known && c.attach != nil {
+		_ = c.attach.Close() // nolint
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	err := r.Client.BatchV1().Jobs(r.Namespace).Delete(ctx, containerID, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if apierrors.IsNotFound(err) {
+		if known {
+			// the Job was never submitted
+			return nil
+		}
+		return provision.ErrContainerNotFound
+	}
+	return err
+}
+
+// ListContainers lists the Jobs created by gofn in the namespace
+func (r *Runtime) ListContainers(ctx context.Context) ([]provision.Container, error) {
+	jobs, err := r.Client.BatchV1().Jobs(r.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ManagedByLabel + "=gofn",
+	})
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]provision.Container, 0, len(jobs.Items))
+	for i := range jobs.Items {
+		c := jobContainer(&jobs.Items[i])
+		c.State.Running = jobs.Items[i].Status.Active > 0
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+func (r *Runtime) pollInterval() time.Duration {
+	if r.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return r.PollInterval
+}
+
+func (r *Runtime) killed(containerID string) syscall.Signal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.containers[containerID]; ok {
+		return c.killed
+	}
+	return 0
+}
+
+// job returns the Job of the container, or the one to be submitted when
+// the container was not started
+func (r *Runtime) job(ctx context.Context, containerID string) (*batchv1.Job, error) {
+	job, err := r.Client.BatchV1().Jobs(r.Namespace).Get(ctx, containerID, metav1.GetOptions{})
+	if err == nil {
+		return job, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.containers[containerID]; ok && !c.started {
+		return c.job, nil
+	}
+	return nil, provision.ErrContainerNotFound
+}
+
+// pod returns the pod of the container, which is nil until the Job
+// controller creates it. ErrNotStarted is returned for containers not
+// started and provision.ErrContainerNotFound for unknown ones
+func (r *Runtime) pod(ctx context.Context, containerID string) (*corev1.Pod, error) {
+	r.mu.Lock()
+	c, known := r.containers[containerID]
+	started := known && c.started
+	r.mu.Unlock()
+	if known && !started {
+		return nil, ErrNotStarted
+	}
+	pods, err := r.Client.CoreV1().Pods(r.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: ContainerLabel + "=" + containerID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) > 0 {
+		return &pods.Items[0], nil
+	}
+	if !known {
+		if _, err = r.job(ctx, containerID); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// stream connects the attached streams once the pod runs
+func (r *Runtime) stream(containerID string, a *attachment) {
+	defer close(a.done)
+	// stop streaming stdin once the output ends
+	defer a.cancel()
+	pod, err := r.waitRunning(a.ctx, containerID)
+	if err != nil || pod == nil {
+		a.setErr(err)
+		return
+	}
+	if r.Attacher != nil && a.stdin != nil {
+		go func() {
+			err := r.Attacher.Attach(a.ctx, r.Namespace, pod.Name, containerName, a.stdin)
+			if err != nil && a.ctx.Err() == nil {
+				a.setErr(err)
+			}
+		}()
+	}
+	if a.stdout != nil {
+		err = r.copyLogs(a.ctx, pod.Name, true, a.stdout)
+		if err != nil && a.ctx.Err() == nil {
+			a.setErr(err)
+		}
+	}
+}
+
+// waitRunning waits the pod to run or to terminate, the pod is nil when
+// the container is killed before it is scheduled
+func (r *Runtime) waitRunning(ctx context.Context, containerID string) (*corev1.Pod, error) {
+	ticker := time.NewTicker(r.pollInterval())
+	defer ticker.Stop()
+	for {
+		pod, err := r.pod(ctx, containerID)
+		if err != nil {
+			return nil, err
+		}
+		if pod != nil {
+			status := containerStatus(pod)
+			if status != nil && (status.State.Running != nil || status.State.Terminated != nil) {
+				return pod, nil
+			}
+			if err = waitingError(status); err != nil {
+				return nil, err
+			}
+		} else if r.killed(containerID) != 0 {
+			return nil, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *Runtime) copyLogs(ctx context.Context, pod string, follow bool, w io.Writer) error {
+	stream, err := r.Client.CoreV1().Pods(r.Namespace).GetLogs(pod, &corev1.PodLogOptions{
+		Container: containerName,
+		Follow:    follow,
+	}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close() // nolint
+	_, err = io.Copy(w, stream)
+	return err
+}
+
+// attachment connects the streams to the pod in background
+type attachment struct {
+	stdin  io.Reader
+	stdout io.Writer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// streaming is set when the container starts and the streams are
+	// connected, done is closed after that
+	streaming bool
+	err       error
+}
+
+func (a *attachment) setErr(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+func (a *attachment) Close() error {
+	a.cancel()
+	return nil
+}
+
+func (a *attachment) Wait() error {
+	select {
+	case <-a.done:
+	case <-a.ctx.Done():
+		a.mu.Lock()
+		streaming := a.streaming
+		a.mu.Unlock()
+		if streaming {
+			<-a.done
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
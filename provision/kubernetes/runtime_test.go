@@ -0,0 +1,313 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/provision"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeAttacher struct {
+	mu       sync.Mutex
+	stdin    bytes.Buffer
+	attached chan struct{}
+}
+
+func (a *fakeAttacher) Attach(ctx context.Context, namespace, pod, container string, stdin io.Reader) error {
+	b, err := ioutil.ReadAll(stdin)
+	a.mu.Lock()
+	a.stdin.Write(b)
+	a.mu.Unlock()
+	close(a.attached)
+	return err
+}
+
+func newTestRuntime() (*Runtime, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	rt := New(client, nil, "gofn")
+	rt.PollInterval = time.Millisecond
+	return rt, client
+}
+
+// runPod plays the Job controller and the kubelet, it creates the pod of
+// the Job once it is submitted and moves it through the given states
+func runPod(t *testing.T, client *fake.Clientset, containerID string, states ...corev1.ContainerState) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		ctx := context.Background()
+		for {
+			_, err := client.BatchV1().Jobs("gofn").Get(ctx, containerID, metav1.GetOptions{})
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      containerID + "-pod",
+				Namespace: "gofn",
+				Labels:    map[string]string{ContainerLabel: containerID},
+			},
+		}
+		pod, err := client.CoreV1().Pods("gofn").Create(ctx, pod, metav1.CreateOptions{})
+		if err != nil {
+			errs <- err
+			return
+		}
+		for _, state := range states {
+			time.Sleep(5 * time.Millisecond)
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: containerName, State: state}}
+			pod, err = client.CoreV1().Pods("gofn").UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	return errs
+}
+
+var (
+	running    = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	terminated = func(code int32, reason string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: code, Reason: reason}}
+	}
+)
+
+func TestRuntimeRun(t *testing.T) {
+	rt, client := newTestRuntime()
+	attacher := &fakeAttacher{attached: make(chan struct{})}
+	rt.Attacher = attacher
+	ctx := context.Background()
+
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/python"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	kubelet := runPod(t, client, c.ID, running)
+
+	stdout := new(bytes.Buffer)
+	done := make(chan error, 1)
+	go func() {
+		done <- provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{Stdin: strings.NewReader("input")}, stdout, nil)
+	}()
+	<-attacher.attached
+	if err = <-kubelet; err != nil {
+		t.Fatal(err)
+	}
+	// the function ends after reading its input
+	pod, err := client.CoreV1().Pods("gofn").Get(ctx, c.ID+"-pod", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: containerName, State: terminated(0, "Completed")}}
+	if _, err = client.CoreV1().Pods("gofn").UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if stdout.String() != "fake logs" {
+		t.Errorf("expected the logs of the pod but found %q", stdout.String())
+	}
+	if attacher.stdin.String() != "input" {
+		t.Errorf("expected %q written to stdin but found %q", "input", attacher.stdin.String())
+	}
+
+	job, err := client.BatchV1().Jobs("gofn").Get(ctx, c.ID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	podSpec := job.Spec.Template.Spec
+	if podSpec.RestartPolicy != corev1.RestartPolicyNever || *job.Spec.BackoffLimit != 0 || !podSpec.Containers[0].Stdin {
+		t.Errorf("expected a Job that runs once with stdin but found %+v", job.Spec)
+	}
+
+	if err = rt.RemoveContainer(ctx, c.ID); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if _, err = rt.InspectContainer(ctx, c.ID); err != provision.ErrContainerNotFound {
+		t.Errorf("Expected %q but found %q", provision.ErrContainerNotFound, err)
+	}
+}
+
+func TestRuntimeExitCodes(t *testing.T) {
+	var tt = []struct {
+		state corev1.ContainerState
+		err   error
+	}{
+		{terminated(3, "Error"), &provision.ExitError{Code: 3}},
+		{terminated(137, "OOMKilled"), provision.ErrOOMKilled},
+	}
+	for _, tc := range tt {
+		rt, client := newTestRuntime()
+		ctx := context.Background()
+		c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/python"})
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		kubelet := runPod(t, client, c.ID, running, tc.state)
+		err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{}, nil, nil)
+		if err == nil || err.Error() != tc.err.Error() {
+			t.Errorf("Expected %q but found %v", tc.err, err)
+		}
+		if err = <-kubelet; err != nil {
+			t.Fatal(err)
+		}
+		info, err := rt.InspectContainer(ctx, c.ID)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if info.State.ExitCode != int(tc.state.Terminated.ExitCode) {
+			t.Errorf("expected exit code %d but found %+v", tc.state.Terminated.ExitCode, info.State)
+		}
+	}
+}
+
+func TestRuntimeTimeout(t *testing.T) {
+	rt, client := newTestRuntime()
+	ctx := context.Background()
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/python"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	kubelet := runPod(t, client, c.ID, running)
+
+	err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{Timeout: 50 * time.Millisecond}, nil, nil)
+	if err != provision.ErrTimeout {
+		t.Errorf("Expected %q but found %q", provision.ErrTimeout, err)
+	}
+	if err = <-kubelet; err != nil {
+		t.Fatal(err)
+	}
+	pods, err := client.CoreV1().Pods("gofn").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("expected the pod to be deleted but found %+v", pods.Items)
+	}
+}
+
+func TestRuntimeKilledBeforeScheduled(t *testing.T) {
+	rt, client := newTestRuntime()
+	ctx := context.Background()
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/python"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{Timeout: time.Millisecond}, nil, nil)
+	if err != provision.ErrTimeout {
+		t.Errorf("Expected %q but found %q", provision.ErrTimeout, err)
+	}
+	jobs, err := client.BatchV1().Jobs("gofn").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("expected the Job to be deleted but found %+v", jobs.Items)
+	}
+	if err = rt.RemoveContainer(ctx, c.ID); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
+func TestRuntimeImagePullError(t *testing.T) {
+	rt, client := newTestRuntime()
+	ctx := context.Background()
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/missing"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	runPod(t, client, c.ID, corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull"}})
+	err = provision.RunContainer(ctx, rt, c.ID, provision.ContainerOptions{}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "ErrImagePull") {
+		t.Errorf("expected an image pull error but found %v", err)
+	}
+}
+
+func TestRuntimeListContainers(t *testing.T) {
+	rt, _ := newTestRuntime()
+	ctx := context.Background()
+	c, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/python"})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = rt.StartContainer(ctx, c.ID); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	containers, err := rt.ListContainers(ctx)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(containers) != 1 || containers[0].ID != c.ID || containers[0].Image != "gofn/python" {
+		t.Errorf("expected container %q but found %+v", c.ID, containers)
+	}
+	if err = rt.RemoveContainer(ctx, c.ID); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	if err = rt.RemoveContainer(ctx, c.ID); err != provision.ErrContainerNotFound {
+		t.Errorf("Expected %q but found %q", provision.ErrContainerNotFound, err)
+	}
+}
+
+func TestPodSpec(t *testing.T) {
+	spec, err := podSpec(provision.ContainerOptions{
+		Image:          "gofn/python",
+		Cmd:            []string{"main.py"},
+		Env:            []string{"A=1"},
+		Volumes:        []string{"/data:/data:ro"},
+		Runtime:        "gvisor",
+		Memory:         64 * 1024 * 1024,
+		CPUQuota:       50000,
+		CPUShares:      512,
+		User:           "1000:1000",
+		ReadOnlyRootfs: true,
+		Tmpfs:          map[string]string{"/tmp": "rw,size=64m"},
+		CapDrop:        []string{"ALL"},
+		SecurityOpt:    []string{"no-new-privileges"},
+		ExtraHosts:     []string{"db:10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	c := spec.Containers[0]
+	if c.Image != "gofn/python" || len(c.Args) != 1 || len(c.Env) != 1 || c.Env[0].Value != "1" {
+		t.Errorf("expected the image, command and environment to be set but found %+v", c)
+	}
+	if spec.RuntimeClassName == nil || *spec.RuntimeClassName != "gvisor" {
+		t.Errorf("expected runtime class gvisor but found %v", spec.RuntimeClassName)
+	}
+	if c.Resources.Limits.Memory().Value() != 64*1024*1024 || c.Resources.Limits.Cpu().MilliValue() != 500 || c.Resources.Requests.Cpu().MilliValue() != 500 {
+		t.Errorf("expected memory and cpu limits but found %+v", c.Resources)
+	}
+	if len(spec.Volumes) != 2 || len(c.VolumeMounts) != 2 || !c.VolumeMounts[0].ReadOnly {
+		t.Errorf("expected a read only volume and a tmpfs but found %+v", c.VolumeMounts)
+	}
+	if size := spec.Volumes[1].EmptyDir.SizeLimit; size == nil || size.Value() != 64*1024*1024 {
+		t.Errorf("expected a 64Mi tmpfs but found %v", size)
+	}
+	sc := c.SecurityContext
+	if *sc.RunAsUser != 1000 || *sc.RunAsGroup != 1000 || !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation || sc.Capabilities.Drop[0] != "ALL" {
+		t.Errorf("expected the security options to be set but found %+v", sc)
+	}
+	if len(spec.HostAliases) != 1 || spec.HostAliases[0].IP != "10.0.0.1" {
+		t.Errorf("expected a host alias but found %+v", spec.HostAliases)
+	}
+
+	_, err = podSpec(provision.HardenedDefaults())
+	if err != provision.ErrNotSupported {
+		t.Errorf("Expected %q but found %q", provision.ErrNotSupported, err)
+	}
+}
@@ -0,0 +1,297 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofn/gofn/provision"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// defaultCPUPeriod is the CFS period used by Docker when CPUPeriod is zero
+const defaultCPUPeriod = 100000
+
+// podSpec translates the options into the spec of the pod, options which
+// have no equivalent in Kubernetes, like NetworkNone or PidsLimit, return
+// provision.ErrNotSupported instead of being ignored
+func podSpec(opts provision.ContainerOptions) (spec corev1.PodSpec, err error) {
+	if opts.MemorySwap != 0 || opts.CPUSetCPUs != "" || opts.PidsLimit > 0 || len(opts.Ulimits) > 0 ||
+		opts.IsolatedNetwork || len(opts.PortBindings) > 0 {
+		err = provision.ErrNotSupported
+		return
+	}
+
+	c := corev1.Container{
+		Name:            containerName,
+		Image:           opts.Image,
+		Args:            opts.Cmd,
+		SecurityContext: &corev1.SecurityContext{},
+	}
+	for _, env := range opts.Env {
+		parts := strings.SplitN(env, "=", 2)
+		v := corev1.EnvVar{Name: parts[0]}
+		if len(parts) == 2 {
+			v.Value = parts[1]
+		}
+		c.Env = append(c.Env, v)
+	}
+	c.Resources = resources(opts)
+
+	spec.RestartPolicy = corev1.RestartPolicyNever
+	if opts.Runtime != "" {
+		runtimeClass := opts.Runtime
+		spec.RuntimeClassName = &runtimeClass
+	}
+	err = volumes(opts, &spec, &c)
+	if err != nil {
+		return
+	}
+	err = network(opts, &spec)
+	if err != nil {
+		return
+	}
+	err = security(opts, &spec, c.SecurityContext)
+	if err != nil {
+		return
+	}
+	spec.Containers = []corev1.Container{c}
+	return
+}
+
+func resources(opts provision.ContainerOptions) (r corev1.ResourceRequirements) {
+	limits := corev1.ResourceList{}
+	requests := corev1.ResourceList{}
+	if opts.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(opts.Memory, resource.BinarySI)
+	}
+	if opts.CPUQuota > 0 {
+		period := opts.CPUPeriod
+		if period <= 0 {
+			period = defaultCPUPeriod
+		}
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(opts.CPUQuota*1000/period, resource.DecimalSI)
+	}
+	if opts.CPUShares > 0 {
+		// 1024 shares are one CPU
+		requests[corev1.ResourceCPU] = *resource.NewMilliQuantity(opts.CPUShares*1000/1024, resource.DecimalSI)
+	}
+	if len(limits) > 0 {
+		r.Limits = limits
+	}
+	if len(requests) > 0 {
+		r.Requests = requests
+	}
+	return
+}
+
+// volumes mounts the volumes, in the source:destination[:ro] format, from
+// the node and the tmpfs mounts as memory backed empty dirs, only the size
+// option of the tmpfs mounts is kept
+func volumes(opts provision.ContainerOptions, spec *corev1.PodSpec, c *corev1.Container) error {
+	for i, volume := range opts.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("kubernetes: invalid volume %q", volume)
+		}
+		name := fmt.Sprintf("volume-%d", i)
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: parts[0]},
+			},
+		})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: parts[1],
+			ReadOnly:  len(parts) == 3 && readOnly(parts[2]),
+		})
+	}
+	i := 0
+	for destination, options := range opts.Tmpfs {
+		emptyDir := &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}
+		for _, option := range strings.Split(options, ",") {
+			if !strings.HasPrefix(option, "size=") {
+				continue
+			}
+			size, err := tmpfsSize(strings.TrimPrefix(option, "size="))
+			if err != nil {
+				return err
+			}
+			emptyDir.SizeLimit = &size
+		}
+		name := fmt.Sprintf("tmpfs-%d", i)
+		i++
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir},
+		})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: destination,
+		})
+	}
+	return nil
+}
+
+func readOnly(options string) bool {
+	for _, option := range strings.Split(options, ",") {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// tmpfsSize converts sizes like 64m into quantities like 64Mi
+func tmpfsSize(size string) (resource.Quantity, error) {
+	size = strings.ToLower(size)
+	if n := len(size); n > 0 {
+		switch size[n-1] {
+		case 'k', 'm', 'g':
+			size = size[:n-1] + strings.ToUpper(size[n-1:]) + "i"
+		}
+	}
+	return resource.ParseQuantity(size)
+}
+
+func network(opts provision.ContainerOptions, spec *corev1.PodSpec) error {
+	switch opts.NetworkMode {
+	case "", provision.NetworkBridge:
+	case provision.NetworkHost:
+		spec.HostNetwork = true
+	default:
+		return provision.ErrNotSupported
+	}
+	if len(opts.DNS) > 0 {
+		spec.DNSPolicy = corev1.DNSNone
+		spec.DNSConfig = &corev1.PodDNSConfig{Nameservers: opts.DNS}
+	}
+	aliases := make(map[string]int)
+	for _, host := range opts.ExtraHosts {
+		i := strings.Index(host, ":")
+		if i < 0 {
+			return fmt.Errorf("kubernetes: invalid extra host %q", host)
+		}
+		hostname, ip := host[:i], host[i+1:]
+		if n, ok := aliases[ip]; ok {
+			spec.HostAliases[n].Hostnames = append(spec.HostAliases[n].Hostnames, hostname)
+			continue
+		}
+		aliases[ip] = len(spec.HostAliases)
+		spec.HostAliases = append(spec.HostAliases, corev1.HostAlias{IP: ip, Hostnames: []string{hostname}})
+	}
+	return nil
+}
+
+func security(opts provision.ContainerOptions, spec *corev1.PodSpec, sc *corev1.SecurityContext) error {
+	if opts.User != "" {
+		parts := strings.SplitN(opts.User, ":", 2)
+		uid, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("kubernetes: user %q must be numeric", opts.User)
+		}
+		sc.RunAsUser = &uid
+		if len(parts) == 2 {
+			gid, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("kubernetes: user %q must be numeric", opts.User)
+			}
+			sc.RunAsGroup = &gid
+		}
+	}
+	if len(opts.GroupAdd) > 0 {
+		spec.SecurityContext = &corev1.PodSecurityContext{}
+		for _, group := range opts.GroupAdd {
+			gid, err := strconv.ParseInt(group, 10, 64)
+			if err != nil {
+				return fmt.Errorf("kubernetes: group %q must be numeric", group)
+			}
+			spec.SecurityContext.SupplementalGroups = append(spec.SecurityContext.SupplementalGroups, gid)
+		}
+	}
+	if opts.ReadOnlyRootfs {
+		readOnly := true
+		sc.ReadOnlyRootFilesystem = &readOnly
+	}
+	if len(opts.CapAdd) > 0 || len(opts.CapDrop) > 0 {
+		sc.Capabilities = &corev1.Capabilities{
+			Add:  capabilities(opts.CapAdd),
+			Drop: capabilities(opts.CapDrop),
+		}
+	}
+	for _, opt := range opts.SecurityOpt {
+		switch opt {
+		case "no-new-privileges", "no-new-privileges:true":
+			escalation := false
+			sc.AllowPrivilegeEscalation = &escalation
+		default:
+			return provision.ErrNotSupported
+		}
+	}
+	return nil
+}
+
+// capabilities removes the CAP_ prefix, not used by Kubernetes
+func capabilities(caps []string) []corev1.Capability {
+	var names []corev1.Capability
+	for _, c := range caps {
+		names = append(names, corev1.Capability(strings.TrimPrefix(strings.ToUpper(c), "CAP_")))
+	}
+	return names
+}
+
+// containerStatus returns the status of the function container, nil until
+// the pod is scheduled
+func containerStatus(pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == containerName {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// waitingError returns an error when the container can not start
+func waitingError(status *corev1.ContainerStatus) error {
+	if status == nil || status.State.Waiting == nil {
+		return nil
+	}
+	switch reason := status.State.Waiting.Reason; reason {
+	case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+		return fmt.Errorf("kubernetes: %v: %v", reason, status.State.Waiting.Message)
+	}
+	return nil
+}
+
+func podState(pod *corev1.Pod, state *provision.ContainerState) {
+	status := containerStatus(pod)
+	if status == nil {
+		return
+	}
+	if running := status.State.Running; running != nil {
+		state.Running = true
+		state.StartedAt = running.StartedAt.Time
+	}
+	if terminated := status.State.Terminated; terminated != nil {
+		state.ExitCode = int(terminated.ExitCode)
+		state.OOMKilled = terminated.Reason == "OOMKilled"
+		state.StartedAt = terminated.StartedAt.Time
+		state.FinishedAt = terminated.FinishedAt.Time
+	}
+}
+
+func jobContainer(job *batchv1.Job) provision.Container {
+	c := provision.Container{
+		ID:      job.Name,
+		Name:    job.Name,
+		Created: job.CreationTimestamp.Time,
+		Labels:  job.Annotations,
+	}
+	if containers := job.Spec.Template.Spec.Containers; len(containers) > 0 {
+		c.Image = containers[0].Image
+	}
+	return c
+}
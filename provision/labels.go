@@ -0,0 +1,80 @@
+package provision
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Labels set by gofn on the containers, images and networks it creates, the
+// containers are listed and found by them
+const (
+	// LabelVersion holds the Version of gofn, it marks what gofn created
+	LabelVersion = "gofn.version"
+	// LabelFunction holds the image name of the function
+	LabelFunction = "gofn.function"
+	// LabelInvocation holds the ID of the invocation which created the
+	// container
+	LabelInvocation = "gofn.invocation"
+	// LabelOwner holds the owner of the container or image, see
+	// ContainerOptions.Owner
+	LabelOwner = "gofn.owner"
+	// LabelCreated holds when gofn created the container or image, in the
+	// RFC 3339 format
+	LabelCreated = "gofn.created"
+)
+
+// Version of gofn set in LabelVersion, it is set at build time with
+// -ldflags "-X github.com/gofn/gofn/provision.Version=<version>"
+var Version = "dev"
+
+// DefaultOwner is the owner of what is created without one, the host and
+// the process which created it as "host:pid"
+func DefaultOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// ContainerLabels returns the labels of a container created with opts,
+// invocationID is used when opts.InvocationID is empty. The labels of
+// opts.Labels are kept unless they replace the ones of gofn
+func ContainerLabels(opts ContainerOptions, invocationID string) map[string]string {
+	if opts.InvocationID != "" {
+		invocationID = opts.InvocationID
+	}
+	labels := gofnLabels(opts.Labels, opts.Owner)
+	labels[LabelFunction] = opts.Image
+	labels[LabelInvocation] = invocationID
+	return labels
+}
+
+// ImageLabels returns the labels of an image built with opts, the labels
+// of opts.Labels are kept unless they replace the ones of gofn
+func ImageLabels(opts *BuildOptions) map[string]string {
+	labels := gofnLabels(opts.Labels, opts.Owner)
+	labels[LabelFunction] = opts.GetImageName()
+	return labels
+}
+
+// NetworkLabels returns the labels of a network created by gofn for an
+// invocation
+func NetworkLabels() map[string]string {
+	return gofnLabels(nil, "")
+}
+
+func gofnLabels(user map[string]string, owner string) map[string]string {
+	labels := make(map[string]string, len(user)+5)
+	for k, v := range user {
+		labels[k] = v
+	}
+	if owner == "" {
+		owner = DefaultOwner()
+	}
+	labels[LabelVersion] = Version
+	labels[LabelOwner] = owner
+	labels[LabelCreated] = time.Now().UTC().Format(time.RFC3339)
+	return labels
+}
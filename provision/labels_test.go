@@ -0,0 +1,34 @@
+package provision
+
+import "testing"
+
+func TestImageLabels(t *testing.T) {
+	opts := &BuildOptions{
+		ImageName:               "python",
+		DoNotUsePrefixImageName: true,
+		Labels:                  map[string]string{"team": "fn", LabelFunction: "replaced"},
+	}
+	labels := ImageLabels(opts)
+	if labels[LabelFunction] != "python" {
+		t.Errorf("Expected %q but found %q", "python", labels[LabelFunction])
+	}
+	if labels["team"] != "fn" || labels[LabelVersion] != Version {
+		t.Errorf("Expected the labels of opts and the version but found %v", labels)
+	}
+	if labels[LabelOwner] != DefaultOwner() {
+		t.Errorf("Expected %q but found %q", DefaultOwner(), labels[LabelOwner])
+	}
+	if _, ok := labels[LabelInvocation]; ok {
+		t.Error("Expected no invocation label on images")
+	}
+}
+
+func TestNetworkLabels(t *testing.T) {
+	labels := NetworkLabels()
+	if labels[LabelVersion] != Version || labels[LabelOwner] != DefaultOwner() {
+		t.Errorf("Expected the version and owner labels but found %v", labels)
+	}
+	if _, ok := labels[LabelFunction]; ok {
+		t.Error("Expected no function label on networks")
+	}
+}
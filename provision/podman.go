@@ -0,0 +1,116 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ErrPodmanSocketNotFound is raised when no Podman API socket is found
+var ErrPodmanSocketNotFound = errors.New("provision: podman socket not found")
+
+// podmanWaitInterval is how often WaitContainer checks a container that
+// Podman reported as exited before it finished
+const podmanWaitInterval = 100 * time.Millisecond
+
+// PodmanRuntime is the Runtime backed by the Docker compatible API of
+// Podman, served by "podman system service"
+type PodmanRuntime struct {
+	*DockerRuntime
+}
+
+// NewPodmanRuntime creates a Runtime connected to the Podman API at
+// endPoint, the socket is discovered by PodmanSocket when it is empty
+func NewPodmanRuntime(endPoint string) (*PodmanRuntime, error) {
+	if endPoint == "" {
+		var err error
+		endPoint, err = PodmanSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := FnClient(endPoint, "")
+	if err != nil {
+		return nil, err
+	}
+	return &PodmanRuntime{DockerRuntime: NewDockerRuntime(client)}, nil
+}
+
+// BuildImage builds the image or pulls it when opts.ForcePull is set or
+// the context has no Dockerfile. Podman does not report a missing
+// Dockerfile like Docker does, so it is checked before building
+func (r *PodmanRuntime) BuildImage(ctx context.Context, opts *BuildOptions) (string, error) {
+	if opts.RemoteURI == "" && !opts.ForcePull {
+		if opts.Dockerfile == "" {
+			opts.Dockerfile = "Dockerfile"
+		}
+		if opts.ContextDir == "" {
+			opts.ContextDir = "./"
+		}
+		_, err := os.Stat(filepath.Join(opts.ContextDir, opts.Dockerfile))
+		if os.IsNotExist(err) {
+			err = r.PullImage(ctx, opts)
+			if err != nil {
+				return "", err
+			}
+			return opts.GetImageName(), nil
+		}
+	}
+	return r.DockerRuntime.BuildImage(ctx, opts)
+}
+
+// FindImage returns ErrImageNotFound when the image does not exist, the
+// images built by Podman are also looked up in the localhost registry
+func (r *PodmanRuntime) FindImage(ctx context.Context, name string) (Image, error) {
+	img, err := r.DockerRuntime.FindImage(ctx, name)
+	if err != ErrImageNotFound {
+		return img, err
+	}
+	img, err = r.DockerRuntime.FindImage(ctx, "localhost/"+name)
+	if err != nil {
+		return img, err
+	}
+	img.Name = name
+	return img, nil
+}
+
+// CreateContainer creates the container without starting it. The runtime
+// named "runc", the Docker default, is left to Podman to choose because
+// most distributions ship Podman with crun
+func (r *PodmanRuntime) CreateContainer(ctx context.Context, opts ContainerOptions) (*Container, error) {
+	if opts.Runtime == "runc" {
+		opts.Runtime = ""
+	}
+	return r.DockerRuntime.CreateContainer(ctx, opts)
+}
+
+// WaitContainer waits the container to exit and returns its exit code.
+// Podman may answer before the container leaves the created state or
+// before its exit code is stored, so the state is checked after waiting
+func (r *PodmanRuntime) WaitContainer(ctx context.Context, containerID string) (int, error) {
+	for {
+		code, err := r.DockerRuntime.WaitContainer(ctx, containerID)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				err = ErrContainerNotFound
+			}
+			return code, err
+		}
+		container, err := r.InspectContainer(ctx, containerID)
+		if err != nil {
+			return code, err
+		}
+		if !container.State.Running && !container.State.FinishedAt.IsZero() {
+			return container.State.ExitCode, nil
+		}
+		select {
+		case <-time.After(podmanWaitInterval):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
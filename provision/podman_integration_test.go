@@ -0,0 +1,59 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPodmanRuntimeIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	if _, err := PodmanSocket(); err != nil {
+		t.Skip("skipping podman integration test, no podman socket found")
+	}
+	rt, err := NewPodmanRuntime("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rt.Client.Ping(); err != nil {
+		t.Skipf("skipping podman integration test, podman is not serving the API: %v", err)
+	}
+
+	ctx := context.Background()
+	opts := &BuildOptions{
+		ImageName:  "testpodman",
+		ContextDir: "./testing_data",
+	}
+	name, err := rt.BuildImage(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rt.FindImage(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.CreateContainer(ctx, ContainerOptions{Image: name, Runtime: "runc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.RemoveContainer(ctx, c.ID)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	err = RunContainer(ctx, rt, c.ID, ContainerOptions{Stdin: strings.NewReader("test")}, stdout, stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		t.Error("stdout is empty")
+	}
+	info, err := rt.InspectContainer(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Running || info.State.ExitCode != 0 {
+		t.Errorf("expected the container to exit with status 0 but found %+v", info.State)
+	}
+}
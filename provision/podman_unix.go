@@ -0,0 +1,32 @@
+//+build !windows
+
+package provision
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PodmanSocket returns the endpoint of the Podman API. CONTAINER_HOST is
+// used when it is set, otherwise the rootless socket in XDG_RUNTIME_DIR
+// and then the rootful one are looked up
+func PodmanSocket() (string, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host, nil
+	}
+	var paths []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	paths = append(paths,
+		fmt.Sprintf("/run/user/%d/podman/podman.sock", os.Getuid()),
+		"/run/podman/podman.sock",
+	)
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path, nil
+		}
+	}
+	return "", ErrPodmanSocketNotFound
+}
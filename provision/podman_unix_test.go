@@ -0,0 +1,44 @@
+//+build !windows
+
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPodmanSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv(t, "XDG_RUNTIME_DIR", dir)()
+	defer setenv(t, "CONTAINER_HOST", "")()
+
+	socket := filepath.Join(dir, "podman", "podman.sock")
+	if err = os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	endPoint, err := PodmanSocket()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if endPoint != "unix://"+socket {
+		t.Errorf("expected the rootless socket %q but found %q", socket, endPoint)
+	}
+
+	defer setenv(t, "CONTAINER_HOST", "tcp://127.0.0.1:8080")()
+	endPoint, err = PodmanSocket()
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if endPoint != "tcp://127.0.0.1:8080" {
+		t.Errorf("expected CONTAINER_HOST but found %q", endPoint)
+	}
+}
@@ -0,0 +1,14 @@
+//+build windows
+
+package provision
+
+import "os"
+
+// PodmanSocket returns the endpoint of the Podman API. CONTAINER_HOST is
+// used when it is set, otherwise the pipe of the default Podman machine
+func PodmanSocket() (string, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host, nil
+	}
+	return "npipe:////./pipe/podman-machine-default", nil
+}
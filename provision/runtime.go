@@ -0,0 +1,225 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNotSupported is raised when the runtime can not perform an operation
+var ErrNotSupported = errors.New("provision: operation not supported by the runtime")
+
+// Runtime is a container engine able to run functions, DockerRuntime is
+// the default one
+type Runtime interface {
+	// BuildImage builds the image described by opts and returns its name
+	BuildImage(ctx context.Context, opts *BuildOptions) (string, error)
+	// PullImage pulls the image described by opts from its registry
+	PullImage(ctx context.Context, opts *BuildOptions) error
+	// FindImage returns ErrImageNotFound when the image does not exist
+	FindImage(ctx context.Context, name string) (Image, error)
+	CreateContainer(ctx context.Context, opts ContainerOptions) (*Container, error)
+	StartContainer(ctx context.Context, containerID string) error
+	// AttachContainer streams stdin to the container and its output to
+	// stdout and stderr, nil streams are not attached
+	AttachContainer(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (CloseWaiter, error)
+	// WaitContainer waits the container to exit and returns its exit code
+	WaitContainer(ctx context.Context, containerID string) (int, error)
+	// InspectContainer returns ErrContainerNotFound when the container does not exist
+	InspectContainer(ctx context.Context, containerID string) (*Container, error)
+	Logs(ctx context.Context, containerID string, stdout io.Writer, stderr io.Writer) error
+	KillContainer(ctx context.Context, containerID string, signal syscall.Signal) error
+	// RemoveContainer removes the container even if it is running, it
+	// returns ErrContainerNotFound when the container does not exist
+	RemoveContainer(ctx context.Context, containerID string) error
+	// ListContainers lists the containers created by gofn
+	ListContainers(ctx context.Context) ([]Container, error)
+}
+
+// NetworkRuntime is a Runtime able to create networks isolated from the
+// outside world
+type NetworkRuntime interface {
+	Runtime
+	// CreateNetwork creates an internal network and returns its name
+	CreateNetwork(ctx context.Context) (string, error)
+	RemoveNetwork(ctx context.Context, name string) error
+	// ListNetworks returns the networks created by gofn
+	ListNetworks(ctx context.Context) ([]Network, error)
+}
+
+// Network is a network created by a NetworkRuntime
+type Network struct {
+	Name string
+	// Created is read from LabelCreated, it is zero when unknown
+	Created time.Time
+	// Labels are the labels of the network, see NetworkLabels
+	Labels map[string]string
+}
+
+// CloseWaiter is a stream attached to a container, Wait blocks until the
+// stream ends and Close ends it
+type CloseWaiter interface {
+	io.Closer
+	Wait() error
+}
+
+// Image is an image known by a runtime
+type Image struct {
+	ID   string
+	Name string
+}
+
+// Container is a container created by a runtime
+type Container struct {
+	ID   string
+	Name string
+	// Image is the name of the image and ImageID its ID, which may be
+	// unknown until the container is inspected
+	Image   string
+	ImageID string
+	Created time.Time
+	State   ContainerState
+	// Labels are the labels of the container, see ContainerLabels
+	Labels map[string]string
+}
+
+// ContainerState is the execution state of a container
+type ContainerState struct {
+	Running    bool
+	ExitCode   int
+	OOMKilled  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// RunContainer runs the container writing its output to stdout and stderr
+// while it is produced, opts.Stdin is streamed to the container and an
+// empty stdin is used when it is nil.
+// The run is aborted when ctx is done. When opts.Timeout expires the
+// container is stopped and ErrTimeout is returned with the output produced
+// until then already written
+func RunContainer(ctx context.Context, rt Runtime, containerID string, opts ContainerOptions, stdout io.Writer, stderr io.Writer) (err error) {
+	stdin := opts.Stdin
+	if stdin == nil {
+		stdin = strings.NewReader("")
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	// attach before starting so that no output is lost, stdin is closed
+	// after it is copied so the container sees EOF
+	w, err := rt.AttachContainer(ctx, containerID, stdin, stdout, stderr)
+	if err != nil {
+		return
+	}
+
+	err = rt.StartContainer(ctx, containerID)
+	if err == nil {
+		err = waitContainer(ctx, rt, containerID, opts.Timeout, opts.StopTimeout)
+	}
+	if err != nil && !exited(err) {
+		// the container may still be running, stop reading its output
+		_ = w.Close() // nolint
+	}
+
+	// the stream ends once the container exits, wait for the remaining output
+	// so that nothing writes to stdout and stderr after returning, but keep
+	// the execution error because it is more important
+	attachErr := w.Wait()
+	if err == nil {
+		err = attachErr
+	}
+	return
+}
+
+// WaitContainer wait until container finnish your processing or ctx is done.
+// The returned channel receives exactly one value, ErrOOMKilled when the
+// container reached its memory limit or an *ExitError for other failures
+func WaitContainer(ctx context.Context, rt Runtime, containerID string) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		code, err := rt.WaitContainer(ctx, containerID)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if code != 0 {
+			container, inspectErr := rt.InspectContainer(ctx, containerID)
+			if inspectErr == nil && container.State.OOMKilled {
+				errs <- ErrOOMKilled
+				return
+			}
+			errs <- &ExitError{Code: code}
+			return
+		}
+		errs <- nil
+	}()
+	return errs
+}
+
+// StopContainer sends SIGTERM to the container and kills it when it is
+// still running after the grace period
+func StopContainer(ctx context.Context, rt Runtime, containerID string, grace time.Duration) (err error) {
+	if grace <= 0 {
+		grace = defaultStopTimeout
+	}
+	e := WaitContainer(ctx, rt, containerID)
+	err = rt.KillContainer(ctx, containerID, syscall.SIGTERM)
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-e:
+	case <-timer.C:
+		err = rt.KillContainer(ctx, containerID, syscall.SIGKILL)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// waitContainer waits the container to exit, stopping it when it runs for
+// longer than timeout
+func waitContainer(ctx context.Context, rt Runtime, containerID string, timeout, grace time.Duration) error {
+	e := WaitContainer(ctx, rt, containerID)
+	if timeout <= 0 {
+		return <-e
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-e:
+		return err
+	case <-timer.C:
+	}
+	err := StopContainer(ctx, rt, containerID, grace)
+	if err != nil {
+		// the container may exit on its own as the timeout expires, the
+		// kill fails then and its exit status is returned instead
+		container, inspectErr := rt.InspectContainer(ctx, containerID)
+		if inspectErr != nil || container.State.Running {
+			return err
+		}
+		return <-e
+	}
+	<-e
+	return ErrTimeout
+}
+
+// exited reports whether err means that the container is not running anymore
+func exited(err error) bool {
+	if _, ok := err.(*ExitError); ok {
+		return true
+	}
+	return err == ErrOOMKilled || err == ErrTimeout
+}
@@ -0,0 +1,233 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrNoSSHAuth is raised when there is no SSH agent, key or identity file
+// to authenticate the SSH connection
+var ErrNoSSHAuth = errors.New("provision: no SSH authentication method found")
+
+const (
+	defaultSSHPort    = "22"
+	defaultSSHTimeout = 30 * time.Second
+	// defaultRemoteSocket is the docker socket on the remote host
+	defaultRemoteSocket = "/var/run/docker.sock"
+)
+
+// SSHOptions configure the SSH connection used to reach a docker daemon
+type SSHOptions struct {
+	// Signers are the keys used to authenticate, when it is empty the keys
+	// of the SSH agent in SSH_AUTH_SOCK and the unencrypted IdentityFiles
+	// are used. IdentityFiles defaults to id_ed25519, id_ecdsa and id_rsa
+	// in ~/.ssh
+	Signers       []ssh.Signer
+	IdentityFiles []string
+	// KnownHostsFile verifies the key of the host, ~/.ssh/known_hosts by
+	// default. HostKeyCallback replaces the verification when it is set
+	KnownHostsFile  string
+	HostKeyCallback ssh.HostKeyCallback
+	// Socket is the path of the docker socket on the remote host, it must
+	// be allowed to be forwarded by the SSH server
+	Socket  string
+	Timeout time.Duration
+}
+
+// SSHDialer dials the docker socket of a remote host through SSH, one SSH
+// connection is shared by every dial and opened again when it is closed
+type SSHDialer struct {
+	addr   string
+	socket string
+	config *ssh.ClientConfig
+	// agentSocket is the SSH agent used to authenticate, it is only
+	// connected while the SSH connection is opened
+	agentSocket string
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHDialer parses URLs in the ssh://[user@]host[:port] format, the user
+// defaults to USER. The connection is opened by the first dial
+func NewSSHDialer(rawURL string, opts SSHOptions) (*SSHDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("provision: invalid SSH URL %q", rawURL)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("provision: invalid SSH URL %q, paths are not supported", rawURL)
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultSSHPort
+	}
+	auth, agentSocket, err := sshAuth(opts)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback := opts.HostKeyCallback
+	if hostKeyCallback == nil {
+		knownHostsFile := opts.KnownHostsFile
+		if knownHostsFile == "" {
+			knownHostsFile = filepath.Join(homeDir(), ".ssh", "known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultSSHTimeout
+	}
+	socket := opts.Socket
+	if socket == "" {
+		socket = defaultRemoteSocket
+	}
+	return &SSHDialer{
+		addr:        net.JoinHostPort(u.Hostname(), port),
+		socket:      socket,
+		agentSocket: agentSocket,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         timeout,
+		},
+	}, nil
+}
+
+// Dial connects to the docker socket of the remote host, network and
+// address are ignored
+func (d *SSHDialer) Dial(network, address string) (net.Conn, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("unix", d.socket)
+	if err == nil {
+		return conn, nil
+	}
+	// the connection may have been closed by the server, it is opened
+	// again once
+	d.reset(client)
+	client, err = d.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial("unix", d.socket)
+}
+
+// Close closes the SSH connection
+func (d *SSHDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
+
+func (d *SSHDialer) connect() (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	config := d.config
+	if d.agentSocket != "" {
+		conn, err := net.Dial("unix", d.agentSocket)
+		if err == nil {
+			// the agent signs during the handshake only
+			defer conn.Close()
+			withAgent := *d.config
+			withAgent.Auth = append([]ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, d.config.Auth...)
+			config = &withAgent
+		}
+	}
+	client, err := ssh.Dial("tcp", d.addr, config)
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+	return client, nil
+}
+
+func (d *SSHDialer) reset(client *ssh.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == client {
+		_ = d.client.Close()
+		d.client = nil
+	}
+}
+
+// sshAuth returns the authentication methods of opts and the socket of the
+// SSH agent to be used with them, when there is one
+func sshAuth(opts SSHOptions) ([]ssh.AuthMethod, string, error) {
+	if len(opts.Signers) > 0 {
+		return []ssh.AuthMethod{ssh.PublicKeys(opts.Signers...)}, "", nil
+	}
+	var auth []ssh.AuthMethod
+	agentSocket := os.Getenv("SSH_AUTH_SOCK")
+	if agentSocket != "" {
+		conn, err := net.Dial("unix", agentSocket)
+		if err != nil {
+			agentSocket = ""
+		} else {
+			conn.Close()
+		}
+	}
+	files := opts.IdentityFiles
+	if len(files) == 0 {
+		dir := filepath.Join(homeDir(), ".ssh")
+		files = []string{filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_ecdsa"), filepath.Join(dir, "id_rsa")}
+	}
+	var signers []ssh.Signer
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) && len(opts.IdentityFiles) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			// encrypted keys are used through the agent
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("provision: invalid SSH key %v: %v", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 && agentSocket == "" {
+		return nil, "", ErrNoSSHAuth
+	}
+	return auth, agentSocket, nil
+}
@@ -0,0 +1,29 @@
+//+build !windows
+
+package provision
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// FnSSHClient instantiate a docker client that reaches the docker socket of
+// the host in the ssh://[user@]host[:port] URL through SSH
+func FnSSHClient(rawURL string, opts SSHOptions) (*docker.Client, error) {
+	dialer, err := NewSSHDialer(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DockerClient()
+}
+
+// DockerClient instantiate a docker client that dials through d, the SSH
+// connection is kept until d is closed
+func (d *SSHDialer) DockerClient() (*docker.Client, error) {
+	client, err := docker.NewClient("unix://" + d.socket)
+	if err != nil {
+		return nil, err
+	}
+	// the client dials its unix socket with Dialer
+	client.Dialer = d
+	return client, nil
+}
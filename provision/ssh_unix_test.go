@@ -0,0 +1,258 @@
+//+build !windows
+
+package provision
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshServer forwards the unix sockets dialed by its clients to target
+type sshServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	target   string
+
+	mu      sync.Mutex
+	sockets []string
+	conns   []net.Conn
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startSSHServer(t *testing.T, target string, hostKey ssh.Signer, authorized ssh.PublicKey) *sshServer {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{listener: listener, config: config, target: target}
+	go s.serve()
+	return s
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *sshServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-streamlocal@openssh.com" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		var payload struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}
+		if err = ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		target, err := net.Dial("tcp", s.target)
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		s.mu.Lock()
+		s.sockets = append(s.sockets, payload.SocketPath)
+		s.mu.Unlock()
+		go ssh.DiscardRequests(channelReqs)
+		go func() {
+			_, _ = io.Copy(target, channel)
+			target.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(channel, target)
+			channel.Close()
+		}()
+	}
+}
+
+// dropConnections closes the connections of the clients
+func (s *sshServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServer) Close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+func (s *sshServer) URL() string {
+	return "ssh://gofn@" + s.listener.Addr().String()
+}
+
+func writeKnownHosts(t *testing.T, dir, addr string, key ssh.PublicKey) string {
+	path := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	if err := ioutil.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFnSSHClient(t *testing.T) {
+	server := createFakeDockerAPI(t)
+	defer server.Stop()
+	u, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, userKey := newSigner(t), newSigner(t)
+	sshd := startSSHServer(t, u.Host, hostKey, userKey.PublicKey())
+	defer sshd.Close()
+	knownHosts := writeKnownHosts(t, dir, sshd.listener.Addr().String(), hostKey.PublicKey())
+
+	client, err := FnSSHClient(sshd.URL(), SSHOptions{Signers: []ssh.Signer{userKey}, KnownHostsFile: knownHosts})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = client.Ping(); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	rt := NewDockerRuntime(client)
+	ctx := context.Background()
+	container, err := rt.CreateContainer(ctx, ContainerOptions{Image: createFakeImage(client)})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if _, err = rt.InspectContainer(ctx, container.ID); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+	sshd.mu.Lock()
+	sockets := sshd.sockets
+	sshd.mu.Unlock()
+	if len(sockets) == 0 || sockets[0] != defaultRemoteSocket {
+		t.Errorf("expected the docker socket %q to be forwarded but found %v", defaultRemoteSocket, sockets)
+	}
+
+	// the SSH connection is opened again after it is dropped
+	sshd.dropConnections()
+	if err = client.Ping(); err != nil {
+		t.Errorf("Expected no errors but %q found", err)
+	}
+}
+
+func TestFnSSHClientUnknownHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, userKey := newSigner(t), newSigner(t)
+	sshd := startSSHServer(t, "127.0.0.1:1", hostKey, userKey.PublicKey())
+	defer sshd.Close()
+	// known_hosts has another key for the host
+	knownHosts := writeKnownHosts(t, dir, sshd.listener.Addr().String(), newSigner(t).PublicKey())
+
+	client, err := FnSSHClient(sshd.URL(), SSHOptions{Signers: []ssh.Signer{userKey}, KnownHostsFile: knownHosts})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = client.Ping(); err == nil {
+		t.Error("expecting errors for a host key mismatch, but nothing found")
+	}
+}
+
+func TestNewSSHDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv(t, "SSH_AUTH_SOCK", "")()
+	defer setenv(t, "HOME", dir)()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err = ioutil.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var tt = []struct {
+		url string
+		err bool
+	}{
+		{"tcp://127.0.0.1:2376", true},
+		{"ssh://", true},
+		{"ssh://gofn@127.0.0.1/var/run/docker.sock", true},
+		{"ssh://gofn@127.0.0.1", false},
+	}
+	for _, tc := range tt {
+		d, err := NewSSHDialer(tc.url, SSHOptions{Signers: []ssh.Signer{newSigner(t)}, KnownHostsFile: knownHosts})
+		if (err != nil) != tc.err {
+			t.Errorf("%v: expected error %v but found %v", tc.url, tc.err, err)
+		}
+		if err == nil && (d.addr != "127.0.0.1:22" || d.config.User != "gofn") {
+			t.Errorf("%v: expected gofn@127.0.0.1:22 but found %v@%v", tc.url, d.config.User, d.addr)
+		}
+	}
+
+	if _, err = NewSSHDialer("ssh://gofn@127.0.0.1", SSHOptions{KnownHostsFile: knownHosts}); err != ErrNoSSHAuth {
+		t.Errorf("Expected %q but found %q", ErrNoSSHAuth, err)
+	}
+}
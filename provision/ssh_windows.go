@@ -0,0 +1,19 @@
+//+build windows
+
+package provision
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// FnSSHClient is not supported on Windows, the docker client only dials
+// named pipes there
+func FnSSHClient(rawURL string, opts SSHOptions) (*docker.Client, error) {
+	return nil, ErrNotSupported
+}
+
+// DockerClient is not supported on Windows, the docker client only dials
+// named pipes there
+func (d *SSHDialer) DockerClient() (*docker.Client, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,244 @@
+package gofn
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+	"github.com/nuveo/log"
+)
+
+// ReapableIaas lists the machines created by gofn and deletes them through
+// the API of the cloud, like the digitalocean, amazonec2 and google
+// providers
+type ReapableIaas interface {
+	ListMachines(ctx context.Context) ([]iaas.Machine, error)
+	RemoveMachine(ctx context.Context, machine iaas.Machine) error
+}
+
+// ReaperOptions configures a Reaper
+type ReaperOptions struct {
+	// Iaas are the providers whose machines are reaped
+	Iaas []ReapableIaas
+	// Runtimes are the hosts whose gofn containers and networks are
+	// reaped, running containers are never reaped
+	Runtimes []provision.Runtime
+	// MaxAge reaps what was created before it, zero reaps only by the
+	// leases. What has an unknown creation time is never reaped
+	MaxAge time.Duration
+	// Leases tell whether the machines, by name, and the containers and
+	// networks, by their LabelOwner, are used. What has a live lease is
+	// never reaped and what has an expired lease is reaped at once. The
+	// machines used by this process and what it owns are never reaped
+	Leases Leases
+	// DryRun reports what would be reaped without deleting it
+	DryRun bool
+	// Interval reaps in background every Interval until the reaper is
+	// closed, zero only reaps when Reap is called
+	Interval time.Duration
+}
+
+// ReapReport lists what was deleted by Reap, or what would be deleted in a
+// dry run
+type ReapReport struct {
+	Machines   []iaas.Machine
+	Containers []provision.Container
+	Networks   []provision.Network
+}
+
+// Reaper deletes the machines, containers and networks left behind by gofn
+// processes which crashed, found by their age or by the leases of their
+// owners
+type Reaper struct {
+	opts ReaperOptions
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewReaper creates a reaper, it reaps in background when opts.Interval is
+// set
+func NewReaper(opts ReaperOptions) *Reaper {
+	r := &Reaper{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	if opts.Interval > 0 {
+		r.wg.Add(1)
+		go r.reapLoop()
+	}
+	return r
+}
+
+// Reap deletes the machines, containers and networks to be reaped once.
+// Every one is tried even when others fail, the last error is returned
+func (r *Reaper) Reap(ctx context.Context) (ReapReport, error) {
+	return r.reap(ctx, time.Now())
+}
+
+func (r *Reaper) reap(ctx context.Context, now time.Time) (report ReapReport, err error) {
+	for _, service := range r.opts.Iaas {
+		machines, reapErr := r.reapMachines(ctx, service, now)
+		report.Machines = append(report.Machines, machines...)
+		if reapErr != nil {
+			err = reapErr
+		}
+	}
+	for _, rt := range r.opts.Runtimes {
+		containers, reapErr := r.reapContainers(ctx, rt, now)
+		report.Containers = append(report.Containers, containers...)
+		if reapErr != nil {
+			err = reapErr
+		}
+		nrt, ok := rt.(provision.NetworkRuntime)
+		if !ok {
+			continue
+		}
+		networks, reapErr := r.reapNetworks(ctx, nrt, now)
+		report.Networks = append(report.Networks, networks...)
+		if reapErr != nil {
+			err = reapErr
+		}
+	}
+	return
+}
+
+func (r *Reaper) reapMachines(ctx context.Context, service ReapableIaas, now time.Time) (reaped []iaas.Machine, err error) {
+	machines, err := service.ListMachines(ctx)
+	if err != nil {
+		log.Errorf("error trying to list machines %v\n", err)
+		return
+	}
+	for _, machine := range machines {
+		if machineHeld(machine.Name) {
+			continue
+		}
+		reap, reapErr := r.expired(ctx, machine.Name, machine.Created, now)
+		if reapErr == nil && reap && !r.opts.DryRun {
+			log.Debugf("reaping machine %v\n", machine.Name)
+			reapErr = service.RemoveMachine(ctx, machine)
+		}
+		if reapErr != nil {
+			log.Errorf("error trying to reap machine %v: %v\n", machine.Name, reapErr)
+			err = reapErr
+			continue
+		}
+		if reap {
+			reaped = append(reaped, machine)
+		}
+	}
+	return
+}
+
+func (r *Reaper) reapContainers(ctx context.Context, rt provision.Runtime, now time.Time) (reaped []provision.Container, err error) {
+	containers, err := rt.ListContainers(ctx)
+	if err != nil {
+		log.Errorf("error trying to list containers %v\n", err)
+		return
+	}
+	owner := provision.DefaultOwner()
+	for _, container := range containers {
+		if container.State.Running || container.Labels[provision.LabelOwner] == owner {
+			continue
+		}
+		reap, reapErr := r.expired(ctx, container.Labels[provision.LabelOwner], container.Created, now)
+		if reapErr == nil && reap && !r.opts.DryRun {
+			log.Debugf("reaping container %v\n", container.ID)
+			reapErr = rt.RemoveContainer(ctx, container.ID)
+			if reapErr == provision.ErrContainerNotFound {
+				reapErr = nil
+			}
+		}
+		if reapErr != nil {
+			log.Errorf("error trying to reap container %v: %v\n", container.ID, reapErr)
+			err = reapErr
+			continue
+		}
+		if reap {
+			reaped = append(reaped, container)
+		}
+	}
+	return
+}
+
+func (r *Reaper) reapNetworks(ctx context.Context, rt provision.NetworkRuntime, now time.Time) (reaped []provision.Network, err error) {
+	networks, err := rt.ListNetworks(ctx)
+	if err != nil {
+		log.Errorf("error trying to list networks %v\n", err)
+		return
+	}
+	owner := provision.DefaultOwner()
+	for _, network := range networks {
+		if network.Labels[provision.LabelOwner] == owner {
+			continue
+		}
+		reap, reapErr := r.expired(ctx, network.Labels[provision.LabelOwner], network.Created, now)
+		if reapErr == nil && reap && !r.opts.DryRun {
+			log.Debugf("reaping network %v\n", network.Name)
+			reapErr = rt.RemoveNetwork(ctx, network.Name)
+		}
+		if reapErr != nil {
+			log.Errorf("error trying to reap network %v: %v\n", network.Name, reapErr)
+			err = reapErr
+			continue
+		}
+		if reap {
+			reaped = append(reaped, network)
+		}
+	}
+	return
+}
+
+// Close stops reaping in background
+func (r *Reaper) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+}
+
+func (r *Reaper) reapLoop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			report, err := r.Reap(context.Background())
+			if err != nil {
+				log.Errorf("error trying to reap %v\n", err)
+			}
+			if n := len(report.Machines) + len(report.Containers) + len(report.Networks); n > 0 {
+				log.Printf("reaped %v machines, %v containers and %v networks, dry run: %v\n", len(report.Machines), len(report.Containers), len(report.Networks), r.opts.DryRun)
+			}
+		}
+	}
+}
+
+// expired reports whether what was created is reaped, by the lease of id
+// or by its age
+func (r *Reaper) expired(ctx context.Context, id string, created time.Time, now time.Time) (bool, error) {
+	if created.IsZero() {
+		return false, nil
+	}
+	state := LeaseNone
+	if r.opts.Leases != nil && id != "" {
+		var err error
+		state, err = r.opts.Leases.State(ctx, id)
+		if err != nil {
+			return false, err
+		}
+	}
+	switch state {
+	case LeaseAlive:
+		return false, nil
+	case LeaseExpired:
+		return true, nil
+	}
+	return r.opts.MaxAge > 0 && now.Sub(created) > r.opts.MaxAge, nil
+}
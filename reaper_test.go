@@ -0,0 +1,220 @@
+package gofn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/gofntest"
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+)
+
+type reapableIaas struct {
+	mu       sync.Mutex
+	machines []iaas.Machine
+	removed  []string
+}
+
+func (r *reapableIaas) ListMachines(ctx context.Context) ([]iaas.Machine, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]iaas.Machine(nil), r.machines...), nil
+}
+
+func (r *reapableIaas) RemoveMachine(ctx context.Context, machine iaas.Machine) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removed = append(r.removed, machine.Name)
+	return nil
+}
+
+func machineNames(machines []iaas.Machine) (names []string) {
+	for _, m := range machines {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestReaperMaxAge(t *testing.T) {
+	now := time.Now()
+	service := &reapableIaas{machines: []iaas.Machine{
+		{Name: "gofn-old", Created: now.Add(-2 * time.Hour)},
+		{Name: "gofn-new", Created: now.Add(-time.Minute)},
+		{Name: "gofn-unknown"},
+	}}
+	rt := gofntest.NewRuntime()
+	rt.On("gofn/sleep", gofntest.Behavior{Delay: gofntest.Forever})
+	rt.AddImage("gofn/sleep")
+	rt.AddNetwork(provision.Network{
+		Name:    "gofn-crashed",
+		Created: now,
+		Labels:  map[string]string{provision.LabelOwner: "crashed:1"},
+	})
+	ctx := context.Background()
+	exited, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/sleep", Owner: "crashed:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/sleep", Owner: "crashed:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rt.StartContainer(ctx, running.ID); err != nil {
+		t.Fatal(err)
+	}
+	owned, err := rt.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/sleep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ReaperOptions{
+		Iaas:     []ReapableIaas{service},
+		Runtimes: []provision.Runtime{rt},
+		MaxAge:   time.Hour,
+		DryRun:   true,
+	}
+	r := NewReaper(opts)
+	defer r.Close()
+	report, err := r.reap(ctx, now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if names := machineNames(report.Machines); len(names) != 1 || names[0] != "gofn-old" || len(report.Containers) != 0 || len(report.Networks) != 0 {
+		t.Errorf("expected only the old machine to be reaped but found %v, %v and %v", names, report.Containers, report.Networks)
+	}
+	if len(service.removed) != 0 || rt.CallCount("RemoveContainer") != 0 || rt.CallCount("RemoveNetwork") != 0 {
+		t.Error("expected nothing to be deleted in a dry run")
+	}
+
+	opts.DryRun = false
+	r = NewReaper(opts)
+	defer r.Close()
+	report, err = r.reap(ctx, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if names := machineNames(report.Machines); len(names) != 2 {
+		t.Errorf("expected the old machines to be reaped but found %v", names)
+	}
+	if len(report.Containers) != 1 || report.Containers[0].ID != exited.ID {
+		t.Errorf("expected only the container not running of another owner to be reaped but found %v", report.Containers)
+	}
+	if len(report.Networks) != 1 || report.Networks[0].Name != "gofn-crashed" {
+		t.Errorf("expected the network of another owner to be reaped but found %v", report.Networks)
+	}
+	if len(service.removed) != 2 {
+		t.Errorf("expected 2 machines removed but found %v", service.removed)
+	}
+	for _, id := range []string{running.ID, owned.ID} {
+		if err = rt.RemoveContainer(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rt.AssertCleanup(t)
+}
+
+func TestReaperLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leases := &FileLeases{Dir: dir, TTL: time.Hour}
+	if err = leases.Renew("gofn-owned"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = leases.Renew("gofn-released"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = leases.Release("gofn-released"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if err = leases.Renew("gofn-expired"); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(filepath.Join(dir, "gofn-expired"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = leases.Renew("../escape"); err == nil {
+		t.Error("expecting errors for a lease outside of its directory, but nothing found")
+	}
+	ctx := context.Background()
+	for id, want := range map[string]LeaseState{
+		"gofn-owned":    LeaseAlive,
+		"gofn-released": LeaseNone,
+		"gofn-expired":  LeaseExpired,
+	} {
+		state, stateErr := leases.State(ctx, id)
+		if stateErr != nil {
+			t.Fatalf("Expected no errors but %q found", stateErr)
+		}
+		if state != want {
+			t.Errorf("expected the lease of %v to be %v but found %v", id, want, state)
+		}
+	}
+
+	now := time.Now()
+	service := &reapableIaas{machines: []iaas.Machine{
+		{Name: "gofn-owned", Created: now.Add(-2 * time.Hour)},
+		{Name: "gofn-released", Created: now.Add(-2 * time.Hour)},
+		{Name: "gofn-expired", Created: now.Add(-time.Minute)},
+		{Name: "gofn-orphan", Created: now.Add(-time.Minute)},
+	}}
+	r := NewReaper(ReaperOptions{Iaas: []ReapableIaas{service}, Leases: leases, MaxAge: time.Hour})
+	defer r.Close()
+	report, err := r.Reap(ctx)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	names := machineNames(report.Machines)
+	if len(names) != 2 || names[0] != "gofn-expired" || names[1] != "gofn-released" {
+		t.Errorf("expected the expired and old machines to be reaped but found %v", names)
+	}
+}
+
+func TestReaperHeldMachines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leases := &FileLeases{Dir: dir, TTL: time.Hour}
+	machine := &iaas.Machine{Name: "gofn-held", Created: time.Now().Add(-2 * time.Hour)}
+	release := holdMachine(leases, machine)
+	ctx := context.Background()
+	if state, stateErr := leases.State(ctx, machine.Name); stateErr != nil || state != LeaseAlive {
+		t.Errorf("expected the lease of a held machine to be alive but found %v, %v", state, stateErr)
+	}
+
+	service := &reapableIaas{machines: []iaas.Machine{*machine}}
+	r := NewReaper(ReaperOptions{Iaas: []ReapableIaas{service}, MaxAge: time.Hour})
+	defer r.Close()
+	report, err := r.Reap(ctx)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(report.Machines) != 0 {
+		t.Errorf("expected the held machine not to be reaped but found %v", report.Machines)
+	}
+
+	release()
+	release()
+	if state, stateErr := leases.State(ctx, machine.Name); stateErr != nil || state != LeaseNone {
+		t.Errorf("expected the lease of a released machine to be gone but found %v, %v", state, stateErr)
+	}
+	report, err = r.Reap(ctx)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if names := machineNames(report.Machines); len(names) != 1 || names[0] != "gofn-held" {
+		t.Errorf("expected the released machine to be reaped but found %v", names)
+	}
+}
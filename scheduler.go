@@ -0,0 +1,474 @@
+package gofn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gofn/gofn/iaas"
+	"github.com/gofn/gofn/provision"
+	"github.com/nuveo/log"
+)
+
+var (
+	// ErrNoHealthyHost is returned by Scheduler.Run when no host can run the function
+	ErrNoHealthyHost = errors.New("gofn: no healthy host")
+
+	// ErrSchedulerClosed is returned by Scheduler.Run after the scheduler is closed
+	ErrSchedulerClosed = errors.New("gofn: scheduler closed")
+)
+
+// healthCheckTimeout bounds the health check of a host, a host which does
+// not answer within it is down
+var healthCheckTimeout = 10 * time.Second
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	// maxTrackedImages bounds the images looked up in the hosts by
+	// ImageLocality, the oldest one is dropped beyond it
+	maxTrackedImages = 64
+)
+
+// Policy chooses the host of each invocation of a Scheduler
+type Policy int
+
+const (
+	// RoundRobin places the invocations on each healthy host in turn
+	RoundRobin Policy = iota
+	// LeastLoaded places each invocation on the host running fewer gofn
+	// containers
+	LeastLoaded
+	// ImageLocality places each invocation on the least loaded host which
+	// already has the image of the function, or on the least loaded host
+	// when none has it
+	ImageLocality
+)
+
+// SchedulerHost is a Docker host of a Scheduler. Runtime is used when it is
+// set, otherwise the machine of Iaas is provided by NewScheduler and deleted
+// when the scheduler is closed
+type SchedulerHost struct {
+	Name    string
+	Runtime provision.Runtime
+	Iaas    iaas.Iaas
+}
+
+// SchedulerOptions configures a Scheduler
+type SchedulerOptions struct {
+	Policy Policy
+	// HealthCheckInterval is how often the hosts are checked, a host is
+	// healthy when it lists its containers. Zero checks every 30 seconds
+	HealthCheckInterval time.Duration
+	// MaxAttempts is the number of hosts tried by an invocation whose host
+	// goes down before the container is created, every healthy host is
+	// tried when it is zero
+	MaxAttempts int
+	// Leases keeps the lease of each machine provided for the hosts, by
+	// name, until the scheduler is closed
+	Leases LeaseHolder
+}
+
+// HostStatus describes a host of a Scheduler
+type HostStatus struct {
+	Name    string
+	Healthy bool
+	// Running is the number of gofn containers running in the host at the
+	// last health check, corrected by the invocations started and finished
+	// since then
+	Running int
+	// Err is the error of the last health check
+	Err error
+}
+
+type scheduledHost struct {
+	SchedulerHost
+	// rt and machine are set by NewScheduler, release gives the machine up
+	rt      provision.Runtime
+	machine *iaas.Machine
+	release func()
+
+	// guarded by Scheduler.mu
+	healthy         bool
+	running         int
+	inflight        int
+	inflightAtCheck int
+	images          map[string]bool
+	err             error
+}
+
+// load estimates the containers running in the host, the containers of
+// the invocations which finished since the last check are not running
+// anymore and the ones started since then were not listed
+func (h *scheduledHost) load() int {
+	load := h.running + h.inflight - h.inflightAtCheck
+	if load < 0 {
+		return 0
+	}
+	return load
+}
+
+// Scheduler places each invocation on one of a fleet of Docker hosts by
+// Policy, hosts which fail their health check receive no invocations until
+// they recover
+type Scheduler struct {
+	opts  SchedulerOptions
+	hosts []*scheduledHost
+
+	mu   sync.Mutex
+	next int
+	// images are looked up in the hosts by ImageLocality, tracked keeps
+	// them from the oldest to drop it beyond maxTrackedImages
+	images  map[string]bool
+	tracked []string
+	closed  bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewScheduler creates a scheduler for hosts, the machines of the hosts
+// with Iaas are provided within ctx and every host is checked before it
+// returns and then every opts.HealthCheckInterval. When a machine can not
+// be provided, the ones already provided are deleted
+func NewScheduler(ctx context.Context, hosts []SchedulerHost, opts SchedulerOptions) (*Scheduler, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("gofn: scheduler without hosts")
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	s := &Scheduler{
+		opts:   opts,
+		images: make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	for _, h := range hosts {
+		if h.Runtime == nil && h.Iaas == nil {
+			return nil, errors.New("gofn: scheduler host without Runtime nor Iaas")
+		}
+		s.hosts = append(s.hosts, &scheduledHost{
+			SchedulerHost: h,
+			rt:            h.Runtime,
+			images:        make(map[string]bool),
+		})
+	}
+	if err := s.provide(ctx); err != nil {
+		return nil, err
+	}
+	s.checkAll(ctx)
+	s.wg.Add(1)
+	go s.healthLoop()
+	return s, nil
+}
+
+// Run runs the function in a host chosen by the policy, the host which
+// ran it is in Result.Host
+func (s *Scheduler) Run(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions) (result *Result, err error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	result, err = s.RunStream(ctx, buildOpts, containerOpts, stdout, stderr)
+	if result != nil {
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+	}
+	return
+}
+
+// RunStream runs the function like Run, but writes its output to stdout and
+// stderr while it is produced. When the host fails before the container is
+// created and it is not healthy anymore, the function runs in another host
+func (s *Scheduler) RunStream(ctx context.Context, buildOpts *provision.BuildOptions, containerOpts *provision.ContainerOptions, stdout io.Writer, stderr io.Writer) (result *Result, err error) {
+	image := buildOpts.GetImageName()
+	if s.opts.Policy == ImageLocality {
+		s.locate(ctx, image)
+	}
+	tried := make(map[*scheduledHost]bool)
+	for {
+		h, pickErr := s.pick(image, tried)
+		if pickErr != nil {
+			if err == nil {
+				err = pickErr
+			}
+			return
+		}
+		tried[h] = true
+		result, err = RunStreamWithRuntime(ctx, h.rt, buildOpts, containerOpts, stdout, stderr)
+		s.finished(h, image, result)
+		if result != nil {
+			result.Host = h.Name
+			result.Machine = h.machine
+		}
+		if err == nil || result != nil || ctx.Err() != nil {
+			return
+		}
+		// the container was not created, the function runs in another
+		// host when this one is down
+		if s.check(ctx, h) {
+			return
+		}
+		log.Errorf("scheduler host %v is down, trying another host: %v\n", h.Name, err)
+		if s.opts.MaxAttempts > 0 && len(tried) >= s.opts.MaxAttempts {
+			return
+		}
+	}
+}
+
+// Hosts returns the status of each host
+func (s *Scheduler) Hosts() []HostStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]HostStatus, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		status = append(status, HostStatus{
+			Name:    h.Name,
+			Healthy: h.healthy,
+			Running: h.load(),
+			Err:     h.err,
+		})
+	}
+	return status
+}
+
+// Close stops the health checks and deletes the machines provided for the
+// hosts, invocations still running are not interrupted
+func (s *Scheduler) Close() (err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+
+	return s.deleteMachines()
+}
+
+// provide provides the machines of the hosts with Iaas concurrently
+func (s *Scheduler) provide(ctx context.Context) (err error) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, h := range s.hosts {
+		if h.rt != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(h *scheduledHost) {
+			defer wg.Done()
+			client, machine, provideErr := ProvideMachine(ctx, h.Iaas)
+			if provideErr != nil {
+				mu.Lock()
+				if err == nil {
+					err = contextError(ctx, provideErr)
+				}
+				mu.Unlock()
+				return
+			}
+			h.rt = provision.NewDockerRuntime(client)
+			h.machine = machine
+			h.release = holdMachine(s.opts.Leases, machine)
+		}(h)
+	}
+	wg.Wait()
+	if err != nil {
+		_ = s.deleteMachines()
+	}
+	return
+}
+
+// deleteMachines deletes the machines provided for the hosts
+func (s *Scheduler) deleteMachines() (err error) {
+	for _, h := range s.hosts {
+		if h.machine == nil {
+			continue
+		}
+		h.release()
+		deleteErr := h.Iaas.DeleteMachine()
+		if deleteErr != nil {
+			log.Errorf("error trying to delete machine %v of host %v: %v\n", h.machine.ID, h.Name, deleteErr)
+			err = deleteErr
+		}
+	}
+	return
+}
+
+func (s *Scheduler) pick(image string, tried map[*scheduledHost]bool) (*scheduledHost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrSchedulerClosed
+	}
+
+	var picked *scheduledHost
+	local := false
+	n := len(s.hosts)
+	// hosts are visited from s.next, so ties are broken in turn
+	for i := 0; i < n; i++ {
+		h := s.hosts[(s.next+i)%n]
+		if !h.healthy || tried[h] {
+			continue
+		}
+		if picked == nil {
+			picked, local = h, h.images[image]
+			if s.opts.Policy == RoundRobin {
+				break
+			}
+			continue
+		}
+		if s.opts.Policy == ImageLocality && h.images[image] != local {
+			if h.images[image] {
+				picked, local = h, true
+			}
+			continue
+		}
+		if h.load() < picked.load() {
+			picked = h
+		}
+	}
+	if picked == nil {
+		return nil, ErrNoHealthyHost
+	}
+	s.next = (s.next + 1) % n
+	picked.inflight++
+	return picked, nil
+}
+
+// locate looks up a new image in the healthy hosts, the health checks
+// update the images seen before
+func (s *Scheduler) locate(ctx context.Context, image string) {
+	s.mu.Lock()
+	seen := s.track(image)
+	var hosts []*scheduledHost
+	for _, h := range s.hosts {
+		if h.healthy {
+			hosts = append(hosts, h)
+		}
+	}
+	s.mu.Unlock()
+	if seen {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h *scheduledHost) {
+			defer wg.Done()
+			// a host which does not answer must not block the invocation
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			img, err := h.rt.FindImage(ctx, image)
+			if err != nil || img.ID == "" {
+				return
+			}
+			s.mu.Lock()
+			if s.images[image] {
+				h.images[image] = true
+			}
+			s.mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+}
+
+// track adds the image to the ones looked up in the hosts and returns
+// whether it was already there, the oldest image is dropped beyond
+// maxTrackedImages. It must be called with s.mu held
+func (s *Scheduler) track(image string) bool {
+	if s.images[image] {
+		return true
+	}
+	s.images[image] = true
+	s.tracked = append(s.tracked, image)
+	if len(s.tracked) > maxTrackedImages {
+		oldest := s.tracked[0]
+		s.tracked = s.tracked[1:]
+		delete(s.images, oldest)
+		for _, h := range s.hosts {
+			delete(h.images, oldest)
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) finished(h *scheduledHost, image string, result *Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.inflight--
+	if result != nil && s.images[image] {
+		// the image was found or built to create the container
+		h.images[image] = true
+	}
+}
+
+func (s *Scheduler) healthLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkAll(context.Background())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, h := range s.hosts {
+		wg.Add(1)
+		go func(h *scheduledHost) {
+			defer wg.Done()
+			s.check(ctx, h)
+		}(h)
+	}
+	wg.Wait()
+}
+
+// check updates the health, the load and the images of the host
+func (s *Scheduler) check(ctx context.Context, h *scheduledHost) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	containers, err := h.rt.ListContainers(ctx)
+	s.mu.Lock()
+	inflight := h.inflight
+	var images []string
+	for image := range s.images {
+		images = append(images, image)
+	}
+	s.mu.Unlock()
+
+	found := make(map[string]bool)
+	if err == nil {
+		for _, image := range images {
+			img, findErr := h.rt.FindImage(ctx, image)
+			if findErr == nil && img.ID != "" {
+				found[image] = true
+			}
+		}
+	}
+	running := 0
+	for _, c := range containers {
+		if c.State.Running {
+			running++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.healthy = err == nil
+	h.err = err
+	if err == nil {
+		h.running = running
+		h.inflightAtCheck = inflight
+		h.images = found
+	}
+	return h.healthy
+}
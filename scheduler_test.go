@@ -0,0 +1,332 @@
+package gofn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofn/gofn/gofntest"
+	"github.com/gofn/gofn/provision"
+)
+
+var errHostDown = errors.New("host down")
+
+// downRuntime fails every operation while it is down, and its health
+// checks block until their context is done while it is stalled, like a host
+// which accepts the connections and never answers
+type downRuntime struct {
+	*gofntest.Runtime
+	mu      sync.Mutex
+	down    bool
+	stalled bool
+}
+
+func (r *downRuntime) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *downRuntime) setStalled(stalled bool) {
+	r.mu.Lock()
+	r.stalled = stalled
+	r.mu.Unlock()
+}
+
+func (r *downRuntime) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		return errHostDown
+	}
+	return nil
+}
+
+func (r *downRuntime) FindImage(ctx context.Context, name string) (provision.Image, error) {
+	if err := r.err(); err != nil {
+		return provision.Image{}, err
+	}
+	return r.Runtime.FindImage(ctx, name)
+}
+
+func (r *downRuntime) ListContainers(ctx context.Context) ([]provision.Container, error) {
+	r.mu.Lock()
+	stalled := r.stalled
+	r.mu.Unlock()
+	if stalled {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	return r.Runtime.ListContainers(ctx)
+}
+
+func newSchedulerHosts(names ...string) ([]SchedulerHost, map[string]*gofntest.Runtime) {
+	var hosts []SchedulerHost
+	runtimes := make(map[string]*gofntest.Runtime)
+	for _, name := range names {
+		rt := gofntest.NewRuntime()
+		rt.On("gofn/hello", gofntest.Behavior{Stdout: "hello"})
+		hosts = append(hosts, SchedulerHost{Name: name, Runtime: rt})
+		runtimes[name] = rt
+	}
+	return hosts, runtimes
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	hosts, runtimes := newSchedulerHosts("a", "b", "c")
+	s, err := NewScheduler(context.Background(), hosts, SchedulerOptions{Policy: RoundRobin})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+
+	var ran []string
+	for i := 0; i < 3; i++ {
+		result, err := s.Run(context.Background(), &provision.BuildOptions{ImageName: "hello"}, nil)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if result.Stdout != "hello" {
+			t.Errorf("Expected %q but found %q", "hello", result.Stdout)
+		}
+		ran = append(ran, result.Host)
+	}
+	if ran[0] != "a" || ran[1] != "b" || ran[2] != "c" {
+		t.Errorf("expected the hosts in turn but found %v", ran)
+	}
+	for name, rt := range runtimes {
+		if n := rt.CallCount("CreateContainer"); n != 1 {
+			t.Errorf("expected one container in host %v but found %d", name, n)
+		}
+		rt.AssertCleanup(t)
+	}
+}
+
+func TestSchedulerLeastLoaded(t *testing.T) {
+	hosts, runtimes := newSchedulerHosts("busy", "idle")
+	// a container of another invocation runs in the first host
+	ctx := context.Background()
+	busy := runtimes["busy"]
+	busy.On("gofn/sleep", gofntest.Behavior{Delay: gofntest.Forever})
+	busy.AddImage("gofn/sleep")
+	c, err := busy.CreateContainer(ctx, provision.ContainerOptions{Image: "gofn/sleep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = busy.StartContainer(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: LeastLoaded})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+	status := s.Hosts()
+	if status[0].Running != 1 || status[1].Running != 0 {
+		t.Errorf("expected one container running in the busy host but found %+v", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := s.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if result.Host != "idle" {
+			t.Errorf("expected the idle host but found %q", result.Host)
+		}
+	}
+	if err = busy.KillContainer(ctx, c.ID, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err = busy.RemoveContainer(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedulerImageLocality(t *testing.T) {
+	hosts, runtimes := newSchedulerHosts("a", "b")
+	runtimes["b"].AddImage("gofn/hello")
+	ctx := context.Background()
+	s, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: ImageLocality})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		result, err := s.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil)
+		if err != nil {
+			t.Fatalf("Expected no errors but %q found", err)
+		}
+		if result.Host != "b" {
+			t.Errorf("expected the host with the image but found %q", result.Host)
+		}
+	}
+	if n := runtimes["b"].CallCount("BuildImage"); n != 0 {
+		t.Errorf("expected the image of host b to be used but it was built %d times", n)
+	}
+}
+
+func TestSchedulerFailover(t *testing.T) {
+	hosts, runtimes := newSchedulerHosts("a", "b")
+	a := &downRuntime{Runtime: runtimes["a"]}
+	hosts[0].Runtime = a
+	ctx := context.Background()
+	s, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: RoundRobin})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+
+	// the host goes down between the health checks
+	a.setDown(true)
+	result, err := s.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if result.Host != "b" {
+		t.Errorf("expected the function to run in host b but found %q", result.Host)
+	}
+	status := s.Hosts()
+	if status[0].Healthy || status[0].Err != errHostDown || !status[1].Healthy {
+		t.Errorf("expected only host a to be down but found %+v", status)
+	}
+
+	a.setDown(false)
+	s.checkAll(ctx)
+	if status = s.Hosts(); !status[0].Healthy {
+		t.Errorf("expected host a to recover but found %+v", status[0])
+	}
+
+	a.setDown(true)
+	down, err := NewScheduler(ctx, []SchedulerHost{{Name: "a", Runtime: a}}, SchedulerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer down.Close()
+	if _, err = down.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil); err != ErrNoHealthyHost {
+		t.Errorf("Expected %q but found %q", ErrNoHealthyHost, err)
+	}
+}
+
+func TestSchedulerStalledHost(t *testing.T) {
+	timeout := healthCheckTimeout
+	healthCheckTimeout = 50 * time.Millisecond
+	defer func() { healthCheckTimeout = timeout }()
+	hosts, runtimes := newSchedulerHosts("a", "b")
+	a := &downRuntime{Runtime: runtimes["a"]}
+	hosts[0].Runtime = a
+	ctx := context.Background()
+	s, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: RoundRobin})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+
+	// the host stops answering between the health checks
+	a.setDown(true)
+	a.setStalled(true)
+	type run struct {
+		result *Result
+		err    error
+	}
+	runs := make(chan run, 1)
+	go func() {
+		result, runErr := s.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil)
+		runs <- run{result, runErr}
+	}()
+	select {
+	case r := <-runs:
+		if r.err != nil {
+			t.Fatalf("Expected no errors but %q found", r.err)
+		}
+		if r.result.Host != "b" {
+			t.Errorf("expected the function to run in host b but found %q", r.result.Host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the function to move to host b when host a does not answer")
+	}
+	status := s.Hosts()
+	if status[0].Healthy || status[0].Err != context.DeadlineExceeded || !status[1].Healthy {
+		t.Errorf("expected only host a to be down but found %+v", status)
+	}
+
+	checked := make(chan struct{})
+	go func() {
+		s.checkAll(ctx)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the health checks to end when host a does not answer")
+	}
+	if status = s.Hosts(); status[0].Healthy || !status[1].Healthy {
+		t.Errorf("expected only host a to be down but found %+v", status)
+	}
+}
+
+func TestSchedulerIaas(t *testing.T) {
+	factory, stop := newFakeFactory(t)
+	defer stop()
+	service, err := factory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	s, err := NewScheduler(ctx, []SchedulerHost{{Name: "machine", Iaas: service}}, SchedulerOptions{})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if status := s.Hosts(); !status[0].Healthy {
+		t.Errorf("expected the host of the machine to be healthy but found %+v", status[0])
+	}
+	// the health checks only ping the machine provided by NewScheduler
+	s.checkAll(ctx)
+	s.checkAll(ctx)
+	if created, _, deleted := factory.count(); created != 1 || deleted != 0 {
+		t.Errorf("expected one machine provided but found %d created and %d deleted", created, deleted)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if created, _, deleted := factory.count(); created != 1 || deleted != 1 {
+		t.Errorf("expected the machine to be deleted but found %d created and %d deleted", created, deleted)
+	}
+}
+
+func TestSchedulerTrackedImages(t *testing.T) {
+	ctx := context.Background()
+	hosts, _ := newSchedulerHosts("a")
+	s, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: RoundRobin})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer s.Close()
+	if _, err = s.Run(ctx, &provision.BuildOptions{ImageName: "hello"}, nil); err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	if len(s.images) != 0 {
+		t.Errorf("expected no images tracked by round robin but found %v", s.images)
+	}
+
+	hosts, _ = newSchedulerHosts("a")
+	local, err := NewScheduler(ctx, hosts, SchedulerOptions{Policy: ImageLocality})
+	if err != nil {
+		t.Fatalf("Expected no errors but %q found", err)
+	}
+	defer local.Close()
+	for i := 0; i <= maxTrackedImages; i++ {
+		local.locate(ctx, fmt.Sprintf("gofn/image-%d", i))
+	}
+	if len(local.images) != maxTrackedImages || local.images["gofn/image-0"] {
+		t.Errorf("expected the %d newest images to be tracked but found %d", maxTrackedImages, len(local.images))
+	}
+}